@@ -0,0 +1,310 @@
+package sregx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// A Span is the part of a text from Start up to but not including End, as
+// byte offsets.
+type Span struct {
+	Start int
+	End   int
+}
+
+// An Address selects a part of a text, as the addresses of the sam editor do.
+// An address is resolved relative to dot, the part of the text selected
+// before, and a sign: 0 for an address that stands alone, or +1 or -1 for an
+// address that follows + or -, which is resolved forward from the end of dot
+// or backward from its start.
+type Address interface {
+	Resolve(b []byte, dot Span, sign int) (Span, error)
+}
+
+// ErrRange is returned when an address lies outside the text.
+var ErrRange = errors.New("address out of range")
+
+// A LineAddr selects a line, including its newline. Line 1 is the first line,
+// and line 0 is the empty string at the start of the text. Following + or -,
+// it selects the line that many lines after or before dot.
+type LineAddr int
+
+// Resolve returns the selected line.
+func (l LineAddr) Resolve(b []byte, dot Span, sign int) (Span, error) {
+	n := int(l)
+	var a Span
+	if sign >= 0 {
+		var p int
+		if n == 0 {
+			if sign == 0 || dot.End == 0 {
+				return Span{}, nil
+			}
+			a.Start = dot.End
+			p = dot.End - 1
+		} else {
+			k := 1
+			if sign != 0 && dot.End != 0 {
+				p = dot.End - 1
+				if b[p] != '\n' {
+					k = 0
+				}
+				p++
+			}
+			for k < n {
+				if p >= len(b) {
+					return a, ErrRange
+				}
+				if b[p] == '\n' {
+					k++
+				}
+				p++
+			}
+			a.Start = p
+		}
+		for p < len(b) {
+			p++
+			if b[p-1] == '\n' {
+				break
+			}
+		}
+		a.End = p
+		return a, nil
+	}
+
+	p := dot.Start
+	if n == 0 {
+		a.End = dot.Start
+	} else {
+		for k := 0; k < n; {
+			if p == 0 {
+				k++
+				if k != n {
+					return a, ErrRange
+				}
+				continue
+			}
+			nl := b[p-1] == '\n'
+			if nl {
+				k++
+			}
+			if !nl || k != n {
+				p--
+			}
+		}
+		a.End = p
+		if p > 0 {
+			p--
+		}
+	}
+	// Lines start after a newline.
+	for p > 0 && b[p-1] != '\n' {
+		p--
+	}
+	a.Start = p
+	return a, nil
+}
+
+// A CharAddr selects the empty string after the given number of characters
+// (runes) of the text. Following + or -, it counts from the end or start of
+// dot.
+type CharAddr int
+
+// Resolve returns the selected empty string.
+func (c CharAddr) Resolve(b []byte, dot Span, sign int) (Span, error) {
+	var p int
+	switch {
+	case sign > 0:
+		p = utf8.RuneCount(b[:dot.End]) + int(c)
+	case sign < 0:
+		p = utf8.RuneCount(b[:dot.Start]) - int(c)
+	default:
+		p = int(c)
+	}
+	if p < 0 {
+		return Span{}, ErrRange
+	}
+	i := 0
+	for ; p > 0; p-- {
+		if i >= len(b) {
+			return Span{}, ErrRange
+		}
+		_, size := utf8.DecodeRune(b[i:])
+		i += size
+	}
+	return Span{i, i}, nil
+}
+
+// EndAddr selects the empty string at the end of the text.
+type EndAddr struct{}
+
+// Resolve returns the end of b.
+func (EndAddr) Resolve(b []byte, dot Span, sign int) (Span, error) {
+	return Span{len(b), len(b)}, nil
+}
+
+// DotAddr selects dot itself.
+type DotAddr struct{}
+
+// Resolve returns dot.
+func (DotAddr) Resolve(b []byte, dot Span, sign int) (Span, error) {
+	return dot, nil
+}
+
+// A SearchAddr selects the next match of Patt after dot, wrapping around to
+// the start of the text if there is none, or if Reverse is set the previous
+// match before dot, wrapping around to the end. Following -, the direction of
+// the search is reversed.
+type SearchAddr struct {
+	Patt    Matcher
+	Reverse bool
+}
+
+// Resolve returns the match found.
+func (s SearchAddr) Resolve(b []byte, dot Span, sign int) (Span, error) {
+	matches := s.Patt.FindAllIndex(b, -1)
+	if len(matches) > 0 {
+		if s.Reverse != (sign < 0) {
+			for i := len(matches) - 1; i >= 0; i-- {
+				if matches[i][1] <= dot.Start {
+					return Span{matches[i][0], matches[i][1]}, nil
+				}
+			}
+			last := matches[len(matches)-1]
+			return Span{last[0], last[1]}, nil
+		}
+		for _, m := range matches {
+			// An empty match at the end of dot would be found again and
+			// again, so it is skipped.
+			if m[0] >= dot.End && !(m[0] == m[1] && m[0] == dot.End) {
+				return Span{m[0], m[1]}, nil
+			}
+		}
+		return Span{matches[0][0], matches[0][1]}, nil
+	}
+	return Span{}, fmt.Errorf("%w for /%s/", ErrNoMatch, s.Patt)
+}
+
+// A CompoundAddr combines two addresses with one of sam's operators:
+//
+//	,  from the start of Left to the end of Right
+//	;  as for ",", but with Right resolved with dot set to Left
+//	+  Right resolved forward from Left
+//	-  Right resolved backward from Left
+//
+// For "," and ";", a nil Left is line 0 and a nil Right is the end of the
+// text. For + and -, a nil Left is dot and a nil Right is line 1.
+type CompoundAddr struct {
+	Left  Address
+	Right Address
+	Op    byte
+}
+
+// Resolve returns the combined address.
+func (c CompoundAddr) Resolve(b []byte, dot Span, sign int) (Span, error) {
+	left, right := c.Left, c.Right
+	switch c.Op {
+	case '+', '-':
+		if left == nil {
+			left = DotAddr{}
+		}
+		if right == nil {
+			right = LineAddr(1)
+		}
+	default:
+		if left == nil {
+			left = LineAddr(0)
+		}
+		if right == nil {
+			right = EndAddr{}
+		}
+	}
+
+	l, err := left.Resolve(b, dot, sign)
+	if err != nil {
+		return l, err
+	}
+	switch c.Op {
+	case '+':
+		return right.Resolve(b, l, 1)
+	case '-':
+		return right.Resolve(b, l, -1)
+	case ';':
+		dot = l
+	}
+	r, err := right.Resolve(b, dot, 0)
+	if err != nil {
+		return r, err
+	}
+	if r.End < l.Start {
+		return Span{}, errors.New("addresses out of order")
+	}
+	return Span{l.Start, r.End}, nil
+}
+
+// At applies Cmd to the part of the input selected by Addr, with dot set to
+// all of the input, and leaves the rest unchanged. If Addr cannot be resolved,
+// the error is reported to Err and the input is returned unchanged.
+type At struct {
+	Addr Address
+	Cmd  Command
+	Err  ErrorHandler
+}
+
+// Evaluate applies Cmd to the addressed part of b.
+func (a At) Evaluate(b []byte) []byte {
+	s, err := a.Addr.Resolve(b, Span{0, len(b)}, 0)
+	if err != nil {
+		a.Err.report(err)
+		return b
+	}
+	return ReplaceSlice(b, s.Start, s.End, a.Cmd.Evaluate(b[s.Start:s.End]))
+}
+
+// Eq writes the location of the part of the input selected by Addr to W, as
+// sam's = command does: the lines it spans, then its character offsets, as in
+// "3,4; #10,#18". If Chars is set, only the character offsets are written. A
+// nil Addr selects all of the input. If Addr cannot be resolved, the error is
+// reported to Err.
+type Eq struct {
+	Addr  Address
+	Chars bool
+	W     io.Writer
+	Err   ErrorHandler
+}
+
+// Evaluate writes the location and returns b unchanged.
+func (e Eq) Evaluate(b []byte) []byte {
+	s := Span{0, len(b)}
+	if e.Addr != nil {
+		var err error
+		s, err = e.Addr.Resolve(b, s, 0)
+		if err != nil {
+			e.Err.report(err)
+			return b
+		}
+	}
+
+	if !e.Chars {
+		l1 := 1 + bytes.Count(b[:s.Start], []byte{'\n'})
+		l2 := l1 + bytes.Count(b[s.Start:s.End], []byte{'\n'})
+		if s.End > s.Start && b[s.End-1] == '\n' {
+			l2--
+		}
+		fmt.Fprint(e.W, l1)
+		if l2 != l1 {
+			fmt.Fprintf(e.W, ",%d", l2)
+		}
+		fmt.Fprint(e.W, "; ")
+	}
+	q0 := utf8.RuneCount(b[:s.Start])
+	q1 := q0 + utf8.RuneCount(b[s.Start:s.End])
+	fmt.Fprintf(e.W, "#%d", q0)
+	if q1 != q0 {
+		fmt.Fprintf(e.W, ",#%d", q1)
+	}
+	fmt.Fprintln(e.W)
+	return b
+}
@@ -0,0 +1,204 @@
+package sregx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// ErrNotNumber is reported by numeric commands when their input is not a
+// number.
+var ErrNotNumber = errors.New("not a number")
+
+// Arith performs arithmetic on a number. The input, ignoring surrounding
+// whitespace, is parsed as a decimal integer or floating point number, or as
+// an integer with a 0x, 0o, or 0b prefix, and combined with Operand according
+// to Op, which is one of '+', '-', or '*'. The result is written in the same
+// base, with the same number of decimal places, and keeping zero padding and
+// the width of space padding where possible. Leading zeros denote zero padding
+// rather than octal. If the input is not a number it is returned unchanged and
+// an error wrapping ErrNotNumber is reported to Err.
+type Arith struct {
+	Op      byte
+	Operand float64
+	Err     ErrorHandler
+}
+
+// Evaluate returns the result of the arithmetic operation on b.
+func (a Arith) Evaluate(b []byte) []byte {
+	trimmed := bytes.TrimLeft(b, " \t")
+	num := bytes.TrimRight(trimmed, " \t\r\n")
+	out, ok := a.apply(string(num))
+	if !ok {
+		a.Err.report(fmt.Errorf("%w: %q", ErrNotNumber, b))
+		return b
+	}
+
+	pad := len(b) - len(trimmed)
+	if pad > 0 {
+		pad = pad + len(num) - len(out)
+		if pad < 1 {
+			pad = 1
+		}
+	}
+	dst := make([]byte, 0, pad+len(out)+len(trimmed)-len(num))
+	dst = append(dst, bytes.Repeat([]byte{' '}, pad)...)
+	dst = append(dst, out...)
+	return append(dst, trimmed[len(num):]...)
+}
+
+// apply parses s and returns the result of the operation formatted like s.
+func (a Arith) apply(s string) (string, bool) {
+	sign, body := "", s
+	if len(body) > 0 && (body[0] == '+' || body[0] == '-') {
+		sign, body = body[:1], body[1:]
+	}
+
+	prefix, digits, base := "", body, 10
+	if len(body) > 2 && body[0] == '0' {
+		switch body[1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			base = 8
+		case 'b', 'B':
+			base = 2
+		}
+		if base != 10 {
+			prefix, digits = body[:2], body[2:]
+		}
+	}
+
+	if isDigits(digits, base) {
+		// Integers are exact at any size, so that results past the bounds of
+		// an int64 neither overflow nor lose precision.
+		v, ok := new(big.Int).SetString(sign+digits, base)
+		if !ok {
+			return "", false
+		}
+		r, ok := a.integer(v)
+		if !ok && base != 10 {
+			// A non-integer operand: keep the base if the result is whole.
+			fv, _ := new(big.Float).SetInt(v).Float64()
+			f := a.float(fv)
+			if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+				return string(formatNumber(f)), true
+			}
+			r, ok = big.NewInt(int64(f)), true
+		}
+		if ok {
+			width := 0
+			if base != 10 || len(digits) > 1 && digits[0] == '0' {
+				width = len(digits)
+			}
+			upper := strings.ContainsAny(digits, "ABCDEF")
+			return formatInt(r, sign, prefix, base, width, upper), true
+		}
+	} else if base != 10 {
+		return "", false
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", false
+	}
+	r := a.float(f)
+	if strings.ContainsAny(body, "eE") {
+		return strconv.FormatFloat(r, 'g', -1, 64), true
+	}
+
+	prec := decimals(body)
+	if p := decimals(strconv.FormatFloat(a.Operand, 'f', -1, 64)); p > prec {
+		prec = p
+	}
+	out := strconv.FormatFloat(math.Abs(r), 'f', prec, 64)
+	if whole := strings.SplitN(body, ".", 2)[0]; len(whole) > 1 && whole[0] == '0' {
+		outWhole := strings.SplitN(out, ".", 2)[0]
+		if len(outWhole) < len(whole) {
+			out = strings.Repeat("0", len(whole)-len(outWhole)) + out
+		}
+	}
+	return signOf(r < 0, sign) + out, true
+}
+
+// integer applies the operation to the integer v, and reports whether the
+// result is an integer.
+func (a Arith) integer(v *big.Int) (*big.Int, bool) {
+	if a.Operand != math.Trunc(a.Operand) || math.Abs(a.Operand) > 1<<53 {
+		return nil, false
+	}
+	n := big.NewInt(int64(a.Operand))
+	switch a.Op {
+	case '+':
+		return n.Add(v, n), true
+	case '-':
+		return n.Sub(v, n), true
+	case '*':
+		return n.Mul(v, n), true
+	}
+	return v, true
+}
+
+// float applies the operation to f.
+func (a Arith) float(f float64) float64 {
+	switch a.Op {
+	case '+':
+		return f + a.Operand
+	case '-':
+		return f - a.Operand
+	case '*':
+		return f * a.Operand
+	}
+	return f
+}
+
+// formatInt formats v in the given base, following the prefix and zero
+// padding the digits to width.
+func formatInt(v *big.Int, sign, prefix string, base, width int, upper bool) string {
+	digits := new(big.Int).Abs(v).Text(base)
+	if upper {
+		digits = strings.ToUpper(digits)
+	}
+	if len(digits) < width {
+		digits = strings.Repeat("0", width-len(digits)) + digits
+	}
+	return signOf(v.Sign() < 0, sign) + prefix + digits
+}
+
+// signOf returns the sign to write for a result, keeping an explicit '+' of
+// the original number. The digits written after it must not have a sign of
+// their own.
+func signOf(neg bool, orig string) string {
+	if neg {
+		return "-"
+	}
+	if orig == "+" {
+		return "+"
+	}
+	return ""
+}
+
+// isDigits reports whether s is a non-empty string of digits in the given
+// base.
+func isDigits(s string, base int) bool {
+	for _, c := range strings.ToLower(s) {
+		i := strings.IndexRune("0123456789abcdef", c)
+		if i == -1 || i >= base {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// decimals returns the number of digits after the decimal point in s.
+func decimals(s string) int {
+	i := strings.IndexByte(s, '.')
+	if i == -1 {
+		return 0
+	}
+	return len(s) - i - 1
+}
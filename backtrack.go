@@ -0,0 +1,1105 @@
+package sregx
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Backtrack is a regular expression compiled for a backtracking engine. It
+// accepts the syntax of regexp, and adds the constructs that need
+// backtracking:
+//
+//	(?=re)   lookahead       (?!re)   negative lookahead
+//	(?<=re)  lookbehind      (?<!re)  negative lookbehind
+//	(?>re)   atomic group    x*+, x++, x?+, x{n,m}+  possessive repetition
+//	\1 - \9  backreference   \k<name> named backreference
+//
+// Groups may also be named with (?<name>re). Matches are leftmost-first, as
+// for regexp. Since a backtracking search can take time exponential in the
+// length of the text, a search is limited to MaxSteps steps plus a small
+// number of steps for each byte of the text, and a lookbehind must have a
+// bounded width. If the limit is reached, an error wrapping ErrBacktrackLimit
+// is reported to Err and the search stops as if there were no more matches.
+type Backtrack struct {
+	MaxSteps int
+	Err      ErrorHandler
+
+	expr  string
+	prog  *btNode
+	names []string // the names of the groups, with "" for group 0
+}
+
+// DefaultMaxSteps is the MaxSteps of a Backtrack returned by
+// CompileBacktrack.
+const DefaultMaxSteps = 1000000
+
+// ErrBacktrackLimit is reported by a Backtrack that reaches its step limit.
+var ErrBacktrackLimit = errors.New("backtracking limit reached")
+
+var _ Submatcher = (*Backtrack)(nil)
+
+// CompileBacktrack parses a regular expression for the backtracking engine.
+func CompileBacktrack(expr string) (*Backtrack, error) {
+	p := &btParser{
+		expr:  expr,
+		names: []string{""},
+	}
+	prog, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing regexp: %v: `%s`", err, expr)
+	}
+	if p.maxRef >= len(p.names) {
+		return nil, fmt.Errorf("error parsing regexp: invalid backreference \\%d: `%s`", p.maxRef, expr)
+	}
+	return &Backtrack{
+		MaxSteps: DefaultMaxSteps,
+		expr:     expr,
+		prog:     prog,
+		names:    p.names,
+	}, nil
+}
+
+// String returns the source text of the regular expression.
+func (bt *Backtrack) String() string {
+	return bt.expr
+}
+
+// NumSubexp returns the number of groups in the regular expression.
+func (bt *Backtrack) NumSubexp() int {
+	return len(bt.names) - 1
+}
+
+// Match reports whether b contains a match.
+func (bt *Backtrack) Match(b []byte) bool {
+	return bt.FindAllSubmatchIndex(b, 1) != nil
+}
+
+// FindAllIndex returns the locations of the successive non-overlapping
+// matches in b. If n >= 0, at most n locations are returned.
+func (bt *Backtrack) FindAllIndex(b []byte, n int) [][]int {
+	matches := bt.FindAllSubmatchIndex(b, n)
+	for i, m := range matches {
+		matches[i] = m[:2]
+	}
+	return matches
+}
+
+// FindAllSubmatchIndex returns the locations of the successive non-overlapping
+// matches in b and of their groups, as regexp.Regexp.FindAllSubmatchIndex
+// does. If n >= 0, at most n matches are returned.
+func (bt *Backtrack) FindAllSubmatchIndex(b []byte, n int) (matches [][]int) {
+	m := &btMachine{
+		b:    b,
+		caps: make([]int, 2*len(bt.names)),
+	}
+	if bt.MaxSteps > 0 {
+		m.max = bt.MaxSteps + btStepsPerByte*len(b)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(btLimit); !ok {
+				panic(r)
+			}
+			bt.Err.report(fmt.Errorf("%w for /%s/", ErrBacktrackLimit, bt.expr))
+		}
+	}()
+
+	prev := -1
+	for pos := 0; pos <= len(b) && (n < 0 || len(matches) < n); {
+		match := m.find(bt.prog, pos, prev)
+		if match == nil {
+			break
+		}
+		matches = append(matches, match)
+		prev = match[1]
+		pos = match[1]
+		if match[0] == match[1] {
+			if pos == len(b) {
+				break
+			}
+			_, size := utf8.DecodeRune(b[pos:])
+			pos += size
+		}
+	}
+	return matches
+}
+
+// Expand appends template to dst with the variables in it replaced by the
+// groups of src given by match, as regexp.Regexp.Expand does: $1 or ${1} is
+// the text of the first group, $name or ${name} that of the group called name,
+// and $$ is a dollar sign.
+func (bt *Backtrack) Expand(dst []byte, template []byte, src []byte, match []int) []byte {
+	for len(template) > 0 {
+		i := strings.IndexByte(string(template), '$')
+		if i < 0 {
+			break
+		}
+		dst = append(dst, template[:i]...)
+		template = template[i:]
+		if len(template) > 1 && template[1] == '$' {
+			dst = append(dst, '$')
+			template = template[2:]
+			continue
+		}
+		name, rest, ok := expandName(template)
+		if !ok {
+			// A malformed variable is copied as it is.
+			dst = append(dst, '$')
+			template = template[1:]
+			continue
+		}
+		template = rest
+		g := -1
+		if num, err := strconv.Atoi(name); err == nil {
+			g = num
+		} else {
+			for j, n := range bt.names {
+				if n == name && n != "" {
+					g = j
+					break
+				}
+			}
+		}
+		if g >= 0 && 2*g+1 < len(match) && match[2*g] >= 0 {
+			dst = append(dst, src[match[2*g]:match[2*g+1]]...)
+		}
+	}
+	return append(dst, template...)
+}
+
+// expandName returns the name of the variable at the start of template, which
+// begins with $, and the rest of the template.
+func expandName(template []byte) (string, []byte, bool) {
+	template = template[1:]
+	brace := len(template) > 0 && template[0] == '{'
+	if brace {
+		template = template[1:]
+	}
+	i := 0
+	for i < len(template) && (isWordRune(rune(template[i])) && template[i] < utf8.RuneSelf) {
+		i++
+	}
+	if i == 0 {
+		return "", nil, false
+	}
+	name := string(template[:i])
+	if brace {
+		if i >= len(template) || template[i] != '}' {
+			return "", nil, false
+		}
+		i++
+	}
+	return name, template[i:], true
+}
+
+type btOp int
+
+const (
+	btChar    btOp = iota // a rune for which pred is true
+	btAssert              // an empty string at which assert is true
+	btConcat              // subs in sequence
+	btAlt                 // one of subs, tried in order
+	btGroup               // subs[0], recorded as group cap
+	btRepeat              // subs[0] repeated from min to max times, or more if max < 0
+	btLook                // lookahead, or lookbehind if behind is set
+	btAtomic              // subs[0], without backtracking into it
+	btBackref             // the text of group cap
+)
+
+// A btNode is a node of the syntax tree of a Backtrack, which is matched
+// directly.
+type btNode struct {
+	op     btOp
+	pred   func(r rune) bool
+	assert func(b []byte, pos int) bool
+	subs   []*btNode
+	cap    int
+	min    int
+	max    int
+	lazy   bool
+	behind bool
+	negate bool
+	fold   bool
+}
+
+// btStepsPerByte is the number of steps a search may take for each byte of the
+// text, in addition to MaxSteps.
+const btStepsPerByte = 100
+
+// btLimit is the value of the panic that stops a search at the step limit.
+type btLimit struct{}
+
+type btMachine struct {
+	b     []byte
+	caps  []int
+	steps int
+	max   int
+}
+
+// find returns the leftmost match in b at or after pos, along with its groups.
+// An empty match at prev, the end of the previous match, is not allowed.
+func (m *btMachine) find(prog *btNode, pos, prev int) []int {
+	for start := pos; start <= len(m.b); {
+		for i := range m.caps {
+			m.caps[i] = -1
+		}
+		end := -1
+		if m.match(prog, start, func(e int) bool {
+			if e == start && start == prev {
+				return false
+			}
+			end = e
+			return true
+		}) {
+			match := append([]int(nil), m.caps...)
+			match[0], match[1] = start, end
+			return match
+		}
+		if start == len(m.b) {
+			break
+		}
+		_, size := utf8.DecodeRune(m.b[start:])
+		start += size
+	}
+	return nil
+}
+
+// match matches n at pos, and then calls k with the position after it. It
+// backtracks into n for as long as k returns false.
+func (m *btMachine) match(n *btNode, pos int, k func(int) bool) bool {
+	m.steps++
+	if m.max > 0 && m.steps > m.max {
+		panic(btLimit{})
+	}
+
+	switch n.op {
+	case btChar:
+		if pos >= len(m.b) {
+			return false
+		}
+		r, size := utf8.DecodeRune(m.b[pos:])
+		return n.pred(r) && k(pos+size)
+	case btAssert:
+		return n.assert(m.b, pos) && k(pos)
+	case btConcat:
+		return m.concat(n.subs, pos, k)
+	case btAlt:
+		for _, sub := range n.subs {
+			if m.match(sub, pos, k) {
+				return true
+			}
+		}
+		return false
+	case btGroup:
+		return m.match(n.subs[0], pos, func(e int) bool {
+			i := 2 * n.cap
+			s0, s1 := m.caps[i], m.caps[i+1]
+			m.caps[i], m.caps[i+1] = pos, e
+			if k(e) {
+				return true
+			}
+			m.caps[i], m.caps[i+1] = s0, s1
+			return false
+		})
+	case btRepeat:
+		return m.repeat(n, 0, pos, k)
+	case btAtomic:
+		saved := append([]int(nil), m.caps...)
+		end := -1
+		if !m.match(n.subs[0], pos, func(e int) bool {
+			end = e
+			return true
+		}) {
+			return false
+		}
+		if k(end) {
+			return true
+		}
+		copy(m.caps, saved)
+		return false
+	case btLook:
+		saved := append([]int(nil), m.caps...)
+		var found bool
+		if n.behind {
+			found = m.lookbehind(n, pos)
+		} else {
+			found = m.match(n.subs[0], pos, func(int) bool { return true })
+		}
+		if found == n.negate {
+			copy(m.caps, saved)
+			return false
+		}
+		if n.negate {
+			copy(m.caps, saved)
+		}
+		if k(pos) {
+			return true
+		}
+		copy(m.caps, saved)
+		return false
+	case btBackref:
+		s, e := m.caps[2*n.cap], m.caps[2*n.cap+1]
+		if s < 0 {
+			return false
+		}
+		end, ok := hasPrefix(m.b[pos:], m.b[s:e], n.fold)
+		return ok && k(pos+end)
+	}
+	panic("unreachable")
+}
+
+func (m *btMachine) concat(subs []*btNode, pos int, k func(int) bool) bool {
+	if len(subs) == 0 {
+		return k(pos)
+	}
+	return m.match(subs[0], pos, func(e int) bool {
+		return m.concat(subs[1:], e, k)
+	})
+}
+
+// repeat matches the repetition n at pos, having matched count repetitions
+// already.
+func (m *btMachine) repeat(n *btNode, count, pos int, k func(int) bool) bool {
+	more := func() bool {
+		if n.max >= 0 && count >= n.max {
+			return false
+		}
+		return m.match(n.subs[0], pos, func(e int) bool {
+			// A repetition of the empty string once the minimum is met
+			// would repeat forever.
+			if e == pos && count >= n.min {
+				return false
+			}
+			return m.repeat(n, count+1, e, k)
+		})
+	}
+	if n.lazy {
+		return count >= n.min && k(pos) || more()
+	}
+	return more() || count >= n.min && k(pos)
+}
+
+// lookbehind reports whether the body of the lookbehind n matches a part of
+// the text ending at pos.
+func (m *btMachine) lookbehind(n *btNode, pos int) bool {
+	for start := pos - n.min; start >= 0 && start >= pos-n.max; start-- {
+		if start < len(m.b) && !utf8.RuneStart(m.b[start]) {
+			continue
+		}
+		if m.match(n.subs[0], start, func(e int) bool { return e == pos }) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPrefix reports whether b begins with prefix, comparing runes up to case
+// if fold is set, and returns the length of the prefix in b.
+func hasPrefix(b, prefix []byte, fold bool) (int, bool) {
+	if !fold {
+		return len(prefix), len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+	}
+	i := 0
+	for _, r := range string(prefix) {
+		if i >= len(b) {
+			return 0, false
+		}
+		c, size := utf8.DecodeRune(b[i:])
+		if !equalFold(c, r) {
+			return 0, false
+		}
+		i += size
+	}
+	return i, true
+}
+
+// equalFold reports whether a and b are equal under simple case folding.
+func equalFold(a, b rune) bool {
+	return a == b || foldRune(a) == foldRune(b)
+}
+
+func isASCIIWord(r rune) bool {
+	return r < utf8.RuneSelf && isWordRune(r)
+}
+
+// atWordBoundary reports whether pos is between an ASCII word character and
+// a non-word character, as \b is for regexp.
+func atWordBoundary(b []byte, pos int) bool {
+	before, after := false, false
+	if pos > 0 {
+		r, _ := utf8.DecodeLastRune(b[:pos])
+		before = isASCIIWord(r)
+	}
+	if pos < len(b) {
+		r, _ := utf8.DecodeRune(b[pos:])
+		after = isASCIIWord(r)
+	}
+	return before != after
+}
+
+// btFlags are the flags of the syntax (?flags) in effect while parsing.
+type btFlags struct {
+	fold      bool // i
+	multiline bool // m
+	dotNL     bool // s
+	ungreedy  bool // U
+}
+
+type btParser struct {
+	expr   string
+	pos    int
+	flags  btFlags
+	names  []string
+	maxRef int
+}
+
+func (p *btParser) parse() (*btNode, error) {
+	n, err := p.alt()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.expr) {
+		return nil, errors.New("unexpected )")
+	}
+	return n, nil
+}
+
+func (p *btParser) more() bool {
+	return p.pos < len(p.expr)
+}
+
+func (p *btParser) peek() rune {
+	r, _ := utf8.DecodeRuneInString(p.expr[p.pos:])
+	return r
+}
+
+func (p *btParser) next() rune {
+	r, size := utf8.DecodeRuneInString(p.expr[p.pos:])
+	p.pos += size
+	return r
+}
+
+func (p *btParser) consume(s string) bool {
+	if strings.HasPrefix(p.expr[p.pos:], s) {
+		p.pos += len(s)
+		return true
+	}
+	return false
+}
+
+// alt parses alternatives separated by |, up to a closing parenthesis or the
+// end of the expression. Flags set within it last until its end.
+func (p *btParser) alt() (*btNode, error) {
+	flags := p.flags
+	defer func() {
+		p.flags = flags
+	}()
+
+	var subs []*btNode
+	for {
+		n, err := p.concat()
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, n)
+		if !p.consume("|") {
+			break
+		}
+	}
+	if len(subs) == 1 {
+		return subs[0], nil
+	}
+	return &btNode{op: btAlt, subs: subs}, nil
+}
+
+func (p *btParser) concat() (*btNode, error) {
+	var subs []*btNode
+	for p.more() && p.peek() != '|' && p.peek() != ')' {
+		n, err := p.atom()
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			continue
+		}
+		n, err = p.quantifier(n)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, n)
+	}
+	if len(subs) == 1 {
+		return subs[0], nil
+	}
+	return &btNode{op: btConcat, subs: subs}, nil
+}
+
+// atom parses a single item of a sequence. It returns nil for an item that
+// matches nothing, such as a flag group.
+func (p *btParser) atom() (*btNode, error) {
+	switch r := p.next(); r {
+	case '(':
+		return p.group()
+	case '[':
+		pred, err := p.class()
+		if err != nil {
+			return nil, err
+		}
+		return &btNode{op: btChar, pred: pred}, nil
+	case '.':
+		if p.flags.dotNL {
+			return &btNode{op: btChar, pred: func(rune) bool { return true }}, nil
+		}
+		return &btNode{op: btChar, pred: func(r rune) bool { return r != '\n' }}, nil
+	case '^':
+		if p.flags.multiline {
+			return assert(func(b []byte, pos int) bool { return pos == 0 || b[pos-1] == '\n' }), nil
+		}
+		return assert(func(b []byte, pos int) bool { return pos == 0 }), nil
+	case '$':
+		if p.flags.multiline {
+			return assert(func(b []byte, pos int) bool { return pos == len(b) || b[pos] == '\n' }), nil
+		}
+		return assert(func(b []byte, pos int) bool { return pos == len(b) }), nil
+	case '*', '+', '?':
+		return nil, errors.New("missing argument to repetition operator: " + string(r))
+	case '\\':
+		return p.escape()
+	default:
+		return p.literal(r), nil
+	}
+}
+
+func assert(f func(b []byte, pos int) bool) *btNode {
+	return &btNode{op: btAssert, assert: f}
+}
+
+func (p *btParser) literal(c rune) *btNode {
+	if p.flags.fold {
+		return &btNode{op: btChar, pred: func(r rune) bool { return equalFold(r, c) }}
+	}
+	return &btNode{op: btChar, pred: func(r rune) bool { return r == c }}
+}
+
+// group parses the rest of a parenthesized group.
+func (p *btParser) group() (*btNode, error) {
+	n := &btNode{op: btGroup}
+	switch {
+	case p.consume("?:"):
+		n.op = btConcat
+	case p.consume("?="):
+		n.op = btLook
+	case p.consume("?!"):
+		n.op, n.negate = btLook, true
+	case p.consume("?<="):
+		n.op, n.behind = btLook, true
+	case p.consume("?<!"):
+		n.op, n.behind, n.negate = btLook, true, true
+	case p.consume("?>"):
+		n.op = btAtomic
+	case p.consume("?P<"), p.consume("?<"):
+		end := strings.IndexByte(p.expr[p.pos:], '>')
+		if end <= 0 {
+			return nil, errors.New("invalid named capture")
+		}
+		name := p.expr[p.pos : p.pos+end]
+		for _, r := range name {
+			if !isASCIIWord(r) {
+				return nil, errors.New("invalid named capture: " + name)
+			}
+		}
+		p.pos += end + 1
+		n.cap = len(p.names)
+		p.names = append(p.names, name)
+	case p.consume("?"):
+		return p.flagGroup()
+	default:
+		n.cap = len(p.names)
+		p.names = append(p.names, "")
+	}
+
+	sub, err := p.alt()
+	if err != nil {
+		return nil, err
+	}
+	if !p.consume(")") {
+		return nil, errors.New("missing closing )")
+	}
+	if n.op == btConcat {
+		return sub, nil
+	}
+	n.subs = []*btNode{sub}
+	if n.behind {
+		// A lookbehind only tries the starts from which its body could
+		// reach the current position.
+		n.min, n.max = width(sub)
+		if n.max < 0 {
+			return nil, errors.New("lookbehind must have a bounded width")
+		}
+	}
+	return n, nil
+}
+
+// width returns the least and greatest number of bytes that n may match, with
+// a greatest of -1 if there is no bound.
+func width(n *btNode) (min, max int) {
+	switch n.op {
+	case btChar:
+		return 1, utf8.UTFMax
+	case btAssert, btLook:
+		return 0, 0
+	case btConcat:
+		for _, sub := range n.subs {
+			lo, hi := width(sub)
+			min += lo
+			if max >= 0 {
+				max = hi + max
+				if hi < 0 {
+					max = -1
+				}
+			}
+		}
+		return min, max
+	case btAlt:
+		for i, sub := range n.subs {
+			lo, hi := width(sub)
+			if i == 0 || lo < min {
+				min = lo
+			}
+			if i == 0 || max >= 0 && (hi < 0 || hi > max) {
+				max = hi
+			}
+		}
+		return min, max
+	case btGroup, btAtomic:
+		return width(n.subs[0])
+	case btRepeat:
+		lo, hi := width(n.subs[0])
+		switch {
+		case hi == 0:
+			return lo * n.min, 0
+		case hi < 0 || n.max < 0:
+			return lo * n.min, -1
+		}
+		return lo * n.min, hi * n.max
+	}
+	// A backreference may match text of any length.
+	return 0, -1
+}
+
+// flagGroup parses the rest of (?flags) or (?flags:re).
+func (p *btParser) flagGroup() (*btNode, error) {
+	flags := p.flags
+	set := true
+	for p.more() {
+		switch r := p.next(); r {
+		case 'i':
+			flags.fold = set
+		case 'm':
+			flags.multiline = set
+		case 's':
+			flags.dotNL = set
+		case 'U':
+			flags.ungreedy = set
+		case '-':
+			set = false
+		case ')':
+			p.flags = flags
+			return nil, nil
+		case ':':
+			saved := p.flags
+			p.flags = flags
+			sub, err := p.alt()
+			p.flags = saved
+			if err != nil {
+				return nil, err
+			}
+			if !p.consume(")") {
+				return nil, errors.New("missing closing )")
+			}
+			return sub, nil
+		default:
+			return nil, errors.New("invalid or unsupported Perl syntax: (?" + string(r))
+		}
+	}
+	return nil, errors.New("missing closing )")
+}
+
+// quantifier parses any repetition operator following n.
+func (p *btParser) quantifier(n *btNode) (*btNode, error) {
+	if !p.more() {
+		return n, nil
+	}
+	min, max := 0, -1
+	start := p.pos
+	switch p.peek() {
+	case '*':
+		p.next()
+	case '+':
+		p.next()
+		min = 1
+	case '?':
+		p.next()
+		max = 1
+	case '{':
+		var ok bool
+		if min, max, ok = p.repeatCount(); !ok {
+			p.pos = start
+			return n, nil
+		}
+	default:
+		return n, nil
+	}
+	if n.op == btAssert || n.op == btLook {
+		// Repeating an empty assertion changes nothing, but is allowed.
+		if min == 0 {
+			return &btNode{op: btConcat}, nil
+		}
+		return n, nil
+	}
+
+	rep := &btNode{
+		op:   btRepeat,
+		subs: []*btNode{n},
+		min:  min,
+		max:  max,
+		lazy: p.flags.ungreedy,
+	}
+	possessive := false
+	if p.consume("?") {
+		rep.lazy = !rep.lazy
+	} else if p.consume("+") {
+		rep.lazy, possessive = false, true
+	}
+	if p.more() && strings.ContainsRune("*+?", p.peek()) {
+		return nil, errors.New("invalid nested repetition operator: " + p.expr[start:p.pos+1])
+	}
+	if possessive {
+		return &btNode{op: btAtomic, subs: []*btNode{rep}}, nil
+	}
+	return rep, nil
+}
+
+// repeatCount parses {n}, {n,}, or {n,m}. If there is none, ok is false and
+// the brace is a literal.
+func (p *btParser) repeatCount() (min, max int, ok bool) {
+	end := strings.IndexByte(p.expr[p.pos:], '}')
+	if end == -1 {
+		return 0, 0, false
+	}
+	body := p.expr[p.pos+1 : p.pos+end]
+	lo, hi := body, body
+	if i := strings.IndexByte(body, ','); i != -1 {
+		lo, hi = body[:i], body[i+1:]
+	}
+	min, err := strconv.Atoi(lo)
+	if err != nil || min < 0 {
+		return 0, 0, false
+	}
+	max = min
+	if hi != lo {
+		max = -1
+		if hi != "" {
+			if max, err = strconv.Atoi(hi); err != nil || max < min {
+				return 0, 0, false
+			}
+		}
+	}
+	p.pos += end + 1
+	return min, max, true
+}
+
+// escape parses the rest of an escape outside a character class.
+func (p *btParser) escape() (*btNode, error) {
+	if !p.more() {
+		return nil, errors.New("trailing backslash at end of expression")
+	}
+	switch r := p.peek(); {
+	case r >= '1' && r <= '9':
+		start := p.pos
+		for p.more() && p.peek() >= '0' && p.peek() <= '9' {
+			p.next()
+		}
+		g, _ := strconv.Atoi(p.expr[start:p.pos])
+		if g > p.maxRef {
+			p.maxRef = g
+		}
+		return &btNode{op: btBackref, cap: g, fold: p.flags.fold}, nil
+	case r == 'k':
+		p.next()
+		end := strings.IndexByte(p.expr[p.pos:], '>')
+		if !p.consume("<") || end == -1 {
+			return nil, errors.New("invalid named backreference")
+		}
+		name := p.expr[p.pos : p.pos+end-1]
+		p.pos += end
+		for i, n := range p.names {
+			if n == name && i > 0 {
+				return &btNode{op: btBackref, cap: i, fold: p.flags.fold}, nil
+			}
+		}
+		return nil, errors.New("unknown group in backreference: " + name)
+	case r == 'b':
+		p.next()
+		return assert(atWordBoundary), nil
+	case r == 'B':
+		p.next()
+		return assert(func(b []byte, pos int) bool { return !atWordBoundary(b, pos) }), nil
+	case r == 'A':
+		p.next()
+		return assert(func(b []byte, pos int) bool { return pos == 0 }), nil
+	case r == 'z':
+		p.next()
+		return assert(func(b []byte, pos int) bool { return pos == len(b) }), nil
+	case r == 'Q':
+		p.next()
+		end := strings.Index(p.expr[p.pos:], `\E`)
+		if end == -1 {
+			end = len(p.expr) - p.pos
+		}
+		var subs []*btNode
+		for _, c := range p.expr[p.pos : p.pos+end] {
+			subs = append(subs, p.literal(c))
+		}
+		p.pos = min(p.pos+end+2, len(p.expr))
+		return &btNode{op: btConcat, subs: subs}, nil
+	}
+
+	pred, c, err := p.classEscape()
+	if err != nil {
+		return nil, err
+	}
+	if pred != nil {
+		return &btNode{op: btChar, pred: pred}, nil
+	}
+	return p.literal(c), nil
+}
+
+// classEscape parses an escape that may appear inside or outside a character
+// class, and returns either a predicate for a class such as \d, or a rune.
+func (p *btParser) classEscape() (func(rune) bool, rune, error) {
+	switch r := p.next(); r {
+	case 'd', 'D', 'w', 'W', 's', 'S':
+		var pred func(rune) bool
+		switch unicode.ToLower(r) {
+		case 'd':
+			pred = func(r rune) bool { return r >= '0' && r <= '9' }
+		case 'w':
+			pred = isASCIIWord
+		case 's':
+			pred = func(r rune) bool { return strings.ContainsRune("\t\n\f\r ", r) }
+		}
+		if unicode.IsUpper(r) {
+			return not(pred), 0, nil
+		}
+		return pred, 0, nil
+	case 'p', 'P':
+		name := ""
+		if p.consume("{") {
+			end := strings.IndexByte(p.expr[p.pos:], '}')
+			if end == -1 {
+				return nil, 0, errors.New("invalid character class range")
+			}
+			name = p.expr[p.pos : p.pos+end]
+			p.pos += end + 1
+		} else if p.more() {
+			name = string(p.next())
+		}
+		negate := r == 'P'
+		if strings.HasPrefix(name, "^") {
+			name, negate = name[1:], !negate
+		}
+		table := unicode.Categories[name]
+		if table == nil {
+			table = unicode.Scripts[name]
+		}
+		var pred func(rune) bool
+		switch {
+		case name == "Any":
+			pred = func(rune) bool { return true }
+		case table != nil:
+			pred = func(r rune) bool { return unicode.Is(table, r) }
+		default:
+			return nil, 0, errors.New("invalid character class range: \\" + string(r) + "{" + name + "}")
+		}
+		if negate {
+			return not(pred), 0, nil
+		}
+		return pred, 0, nil
+	case 'a':
+		return nil, '\a', nil
+	case 'f':
+		return nil, '\f', nil
+	case 't':
+		return nil, '\t', nil
+	case 'n':
+		return nil, '\n', nil
+	case 'r':
+		return nil, '\r', nil
+	case 'v':
+		return nil, '\v', nil
+	case '0':
+		// Up to two more octal digits.
+		c := 0
+		for i := 0; i < 2 && p.more() && p.peek() >= '0' && p.peek() <= '7'; i++ {
+			c = c*8 + int(p.next()-'0')
+		}
+		return nil, rune(c), nil
+	case 'x':
+		var hex string
+		if p.consume("{") {
+			end := strings.IndexByte(p.expr[p.pos:], '}')
+			if end == -1 {
+				return nil, 0, errors.New("invalid escape sequence: \\x{")
+			}
+			hex = p.expr[p.pos : p.pos+end]
+			p.pos += end + 1
+		} else if p.pos+2 <= len(p.expr) {
+			hex = p.expr[p.pos : p.pos+2]
+			p.pos += 2
+		}
+		c, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil || c > unicode.MaxRune {
+			return nil, 0, errors.New("invalid escape sequence: \\x" + hex)
+		}
+		return nil, rune(c), nil
+	default:
+		if r < utf8.RuneSelf && !isASCIIWord(r) {
+			return nil, r, nil
+		}
+		return nil, 0, errors.New("invalid escape sequence: \\" + string(r))
+	}
+}
+
+func not(pred func(rune) bool) func(rune) bool {
+	return func(r rune) bool { return !pred(r) }
+}
+
+// posixClasses are the classes that may appear as [:name:] inside a character
+// class.
+var posixClasses = map[string]func(rune) bool{
+	"alnum":  func(r rune) bool { return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) },
+	"alpha":  func(r rune) bool { return r < utf8.RuneSelf && unicode.IsLetter(r) },
+	"ascii":  func(r rune) bool { return r < utf8.RuneSelf },
+	"blank":  func(r rune) bool { return r == ' ' || r == '\t' },
+	"cntrl":  func(r rune) bool { return r < ' ' || r == 0x7f },
+	"digit":  func(r rune) bool { return r >= '0' && r <= '9' },
+	"graph":  func(r rune) bool { return r > ' ' && r < 0x7f },
+	"lower":  func(r rune) bool { return r >= 'a' && r <= 'z' },
+	"print":  func(r rune) bool { return r >= ' ' && r < 0x7f },
+	"punct":  func(r rune) bool { return r > ' ' && r < 0x7f && !isASCIIWord(r) || r == '_' },
+	"space":  func(r rune) bool { return strings.ContainsRune("\t\n\v\f\r ", r) },
+	"upper":  func(r rune) bool { return r >= 'A' && r <= 'Z' },
+	"word":   isASCIIWord,
+	"xdigit": func(r rune) bool { return strings.ContainsRune("0123456789abcdefABCDEF", r) },
+}
+
+// class parses the rest of a character class, and returns a predicate for the
+// runes it matches.
+func (p *btParser) class() (func(rune) bool, error) {
+	negate := p.consume("^")
+	fold := p.flags.fold
+	var preds []func(rune) bool
+	first := true
+	for {
+		if !p.more() {
+			return nil, errors.New("missing closing ]")
+		}
+		if p.peek() == ']' && !first {
+			p.next()
+			break
+		}
+		first = false
+
+		if p.consume("[:") {
+			end := strings.Index(p.expr[p.pos:], ":]")
+			name := ""
+			if end != -1 {
+				name = p.expr[p.pos : p.pos+end]
+			}
+			pred := posixClasses[strings.TrimPrefix(name, "^")]
+			if pred == nil {
+				return nil, errors.New("invalid character class range: [:" + name + ":]")
+			}
+			if strings.HasPrefix(name, "^") {
+				pred = not(pred)
+			}
+			preds = append(preds, pred)
+			p.pos += end + 2
+			continue
+		}
+
+		lo, pred, err := p.classChar()
+		if err != nil {
+			return nil, err
+		}
+		if pred != nil {
+			preds = append(preds, pred)
+			continue
+		}
+		hi := lo
+		if strings.HasPrefix(p.expr[p.pos:], "-") && !strings.HasPrefix(p.expr[p.pos:], "-]") {
+			p.next()
+			if hi, pred, err = p.classChar(); err != nil {
+				return nil, err
+			}
+			if pred != nil || hi < lo {
+				return nil, errors.New("invalid character class range")
+			}
+		}
+		preds = append(preds, func(r rune) bool { return r >= lo && r <= hi })
+	}
+
+	in := func(r rune) bool {
+		for _, pred := range preds {
+			if pred(r) {
+				return true
+			}
+		}
+		return false
+	}
+	match := in
+	if fold {
+		match = func(r rune) bool {
+			if in(r) {
+				return true
+			}
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				if in(f) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if negate {
+		return not(match), nil
+	}
+	return match, nil
+}
+
+// classChar parses a rune or escape inside a character class.
+func (p *btParser) classChar() (rune, func(rune) bool, error) {
+	if !p.more() {
+		return 0, nil, errors.New("missing closing ]")
+	}
+	if r := p.next(); r != '\\' {
+		return r, nil, nil
+	}
+	if !p.more() {
+		return 0, nil, errors.New("trailing backslash at end of expression")
+	}
+	pred, c, err := p.classEscape()
+	return c, pred, err
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
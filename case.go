@@ -0,0 +1,230 @@
+package sregx
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MatchCase returns repl with the case of match applied to it. If the letters
+// of match are all lowercase, repl is lowercased, and if they are all
+// uppercase (and there is more than one), it is uppercased. If match is
+// titlecase, with only its first letter uppercase, so is the result. Otherwise,
+// if match and repl have the same number of runes, the case of each rune of
+// match is applied to the rune of repl at the same position. In any other case,
+// including when match has no letters, repl is returned unchanged.
+func MatchCase(match, repl []byte) []byte {
+	upper, lower := 0, 0
+	firstUpper := false
+	for _, r := range string(match) {
+		if unicode.IsUpper(r) {
+			firstUpper = firstUpper || upper+lower == 0
+			upper++
+		} else if unicode.IsLower(r) {
+			lower++
+		}
+	}
+
+	switch {
+	case upper == 0 && lower == 0:
+		return repl
+	case upper == 0:
+		return bytes.ToLower(repl)
+	case lower == 0 && upper > 1:
+		return bytes.ToUpper(repl)
+	case firstUpper && upper == 1:
+		return title(repl)
+	case utf8.RuneCount(match) == utf8.RuneCount(repl):
+		rs := []rune(string(repl))
+		i := 0
+		for _, r := range string(match) {
+			if unicode.IsUpper(r) {
+				rs[i] = unicode.ToUpper(rs[i])
+			} else if unicode.IsLower(r) {
+				rs[i] = unicode.ToLower(rs[i])
+			}
+			i++
+		}
+		return []byte(string(rs))
+	}
+	return repl
+}
+
+// title returns b with its first letter in titlecase and the rest lowercase.
+func title(b []byte) []byte {
+	i := bytes.IndexFunc(b, unicode.IsLetter)
+	if i == -1 {
+		return b
+	}
+	r, size := utf8.DecodeRune(b[i:])
+	t := make([]byte, 0, len(b))
+	t = append(t, b[:i]...)
+	t = append(t, string(unicode.ToTitle(r))...)
+	return append(t, bytes.ToLower(b[i+size:])...)
+}
+
+// A Style is a way of writing identifiers made up of several words.
+type Style int
+
+// Identifier styles, as applied to the words "http" and "server".
+const (
+	SnakeCase          Style = iota // http_server
+	CamelCase                       // httpServer
+	PascalCase                      // HttpServer
+	KebabCase                       // http-server
+	ScreamingSnakeCase              // HTTP_SERVER
+)
+
+// Recase converts identifiers to Style. The input is split into words at
+// characters other than letters and digits, between a lowercase letter or
+// digit and an uppercase letter, and before the last uppercase letter of a run
+// followed by a lowercase letter, so that for example HTTPServer is split into
+// HTTP and Server. The words are then joined in Style. Characters other than
+// letters and digits at the start and end of the input are kept.
+type Recase struct {
+	Style Style
+}
+
+// Evaluate returns b converted to Style.
+func (rc Recase) Evaluate(b []byte) []byte {
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	start := bytes.IndexFunc(b, isWord)
+	if start == -1 {
+		return b
+	}
+	end := bytes.LastIndexFunc(b, isWord)
+	_, size := utf8.DecodeRune(b[end:])
+	end += size
+
+	words := splitWords(b[start:end])
+	out := make([]byte, 0, len(b)+len(words))
+	out = append(out, b[:start]...)
+	for i, w := range words {
+		switch rc.Style {
+		case SnakeCase:
+			if i > 0 {
+				out = append(out, '_')
+			}
+			out = append(out, bytes.ToLower(w)...)
+		case KebabCase:
+			if i > 0 {
+				out = append(out, '-')
+			}
+			out = append(out, bytes.ToLower(w)...)
+		case ScreamingSnakeCase:
+			if i > 0 {
+				out = append(out, '_')
+			}
+			out = append(out, bytes.ToUpper(w)...)
+		case CamelCase:
+			if i == 0 {
+				out = append(out, bytes.ToLower(w)...)
+			} else {
+				out = append(out, title(w)...)
+			}
+		case PascalCase:
+			out = append(out, title(w)...)
+		}
+	}
+	return append(out, b[end:]...)
+}
+
+// splitWords splits an identifier into its words.
+func splitWords(b []byte) [][]byte {
+	rs := []rune(string(b))
+	var words [][]byte
+	var word []rune
+	for i, r := range rs {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(word) > 0 {
+				words = append(words, []byte(string(word)))
+				word = nil
+			}
+			continue
+		}
+		if len(word) > 0 && unicode.IsUpper(r) {
+			prev := word[len(word)-1]
+			acronymEnd := unicode.IsUpper(prev) && i+1 < len(rs) && unicode.IsLower(rs[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || acronymEnd {
+				words = append(words, []byte(string(word)))
+				word = nil
+			}
+		}
+		word = append(word, r)
+	}
+	if len(word) > 0 {
+		words = append(words, []byte(string(word)))
+	}
+	return words
+}
+
+// hasCaseModifier reports whether template contains a case modifier or an
+// escaped backslash (see S).
+func hasCaseModifier(template []byte) bool {
+	for i := 0; i+1 < len(template); i++ {
+		if template[i] == '\\' && isCaseModifier(template[i+1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCaseModifier reports whether c follows a backslash in a case modifier, or
+// is the backslash of an escaped backslash.
+func isCaseModifier(c byte) bool {
+	return c == 'U' || c == 'L' || c == 'E' || c == 'u' || c == 'l' || c == '\\'
+}
+
+// expandCase is like sm.Expand, but also applies the case modifiers in
+// template and resolves its escaped backslashes (see S).
+func expandCase(sm Submatcher, template, src []byte, match []int) []byte {
+	var dst []byte
+	// mode is the function applied to text until the next \E, and next is
+	// applied to the next character.
+	var mode, next func(rune) rune
+	for len(template) > 0 {
+		i := 0
+		for ; i < len(template)-1; i++ {
+			if template[i] == '\\' && isCaseModifier(template[i+1]) {
+				break
+			}
+		}
+		if i == len(template)-1 {
+			i = len(template)
+		}
+
+		text := sm.Expand(nil, template[:i], src, match)
+		if i < len(template) && template[i+1] == '\\' {
+			text = append(text, '\\')
+		}
+		if mode != nil {
+			text = bytes.Map(mode, text)
+		}
+		if next != nil && len(text) > 0 {
+			r, size := utf8.DecodeRune(text)
+			text = append([]byte(string(next(r))), text[size:]...)
+			next = nil
+		}
+		dst = append(dst, text...)
+
+		if i == len(template) {
+			break
+		}
+		switch template[i+1] {
+		case 'U':
+			mode = unicode.ToUpper
+		case 'L':
+			mode = unicode.ToLower
+		case 'E':
+			mode = nil
+		case 'u':
+			next = unicode.ToUpper
+		case 'l':
+			next = unicode.ToLower
+		}
+		template = template[i+2:]
+	}
+	return dst
+}
@@ -1,7 +1,11 @@
 package main
 
 var opts struct {
-	Inplace bool `short:"i" long:"in-place" description:"Change the input file in-place"`
-	Version bool `short:"v" long:"version" description:"Show version information"`
-	Help    bool `short:"h" long:"help" description:"Show this help message"`
+	Inplace bool   `short:"i" long:"in-place" description:"Change the input file in-place"`
+	Fixed   bool   `short:"F" long:"fixed-strings" description:"Treat all patterns as literal strings"`
+	Longest bool   `short:"L" long:"longest" description:"Use leftmost-longest matching for all patterns"`
+	Dialect string `long:"dialect" choice:"go" choice:"plan9" default:"go" description:"Regular expression syntax"`
+	Sam     bool   `long:"sam" description:"Read the expression as a script in the command language of sam"`
+	Version bool   `short:"v" long:"version" description:"Show version information"`
+	Help    bool   `short:"h" long:"help" description:"Show this help message"`
 }
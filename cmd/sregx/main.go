@@ -24,10 +24,10 @@ func must(err error) {
 	}
 }
 
-// Returns true if there is a p command used anywhere within this command.
+// Returns true if there is a p or = command used anywhere within this command.
 func hasP(cmd sregx.Command) bool {
 	switch cmd := cmd.(type) {
-	case sregx.P:
+	case sregx.P, sregx.Eq:
 		return true
 	case sregx.CommandPipeline:
 		for _, c := range cmd {
@@ -43,10 +43,41 @@ func hasP(cmd sregx.Command) bool {
 		return hasP(cmd.Cmd)
 	case sregx.V:
 		return hasP(cmd.Cmd)
+	case sregx.GNum:
+		return hasP(cmd.Cmd)
+	case sregx.VNum:
+		return hasP(cmd.Cmd)
 	case sregx.L:
 		return hasP(cmd.Cmd)
+	case sregx.At:
+		return hasP(cmd.Cmd)
 	case sregx.N:
 		return hasP(cmd.Cmd)
+	case sregx.Loop:
+		return hasP(cmd.Cmd)
+	case sregx.Count:
+		return hasP(cmd.Cmd)
+	case sregx.Sum:
+		return hasP(cmd.Cmd)
+	case sregx.Avg:
+		return hasP(cmd.Cmd)
+	case sregx.Min:
+		return hasP(cmd.Cmd)
+	case sregx.Max:
+		return hasP(cmd.Cmd)
+	case sregx.Longest:
+		return hasP(cmd.Cmd)
+	case sregx.Shortest:
+		return hasP(cmd.Cmd)
+	case sregx.Switch:
+		for _, c := range cmd.Cases {
+			if hasP(c.Cmd) {
+				return true
+			}
+		}
+		if cmd.Default != nil {
+			return hasP(cmd.Default)
+		}
 	}
 	return false
 }
@@ -88,28 +119,48 @@ func main() {
 	input.Close()
 
 	output := &bytes.Buffer{}
+	failed := false
 
-	cmds, err := syntax.Compile(args[0], output, map[string]syntax.EvalMaker{
-		// the u command is a custom command that executes a shell command to
-		// perform the transformation.
-		"u": func(s string) (sregx.Evaluator, error) {
-			args, err := shellwords.Parse(s)
-			if err != nil {
-				return nil, err
-			}
+	copts := []syntax.Option{syntax.OnError(func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		failed = true
+	})}
+	if opts.Fixed {
+		copts = append(copts, syntax.FixedStrings())
+	}
+	if opts.Longest {
+		copts = append(copts, syntax.Longest())
+	}
+	if opts.Dialect == "plan9" {
+		copts = append(copts, syntax.Plan9())
+	}
 
-			return func(b []byte) []byte {
-				cmd := exec.Command(args[0], args[1:]...)
-				inbuf := bytes.NewBuffer(b)
-				cmd.Stdin = inbuf
-				out, err := cmd.Output()
+	var cmds sregx.Command
+	if opts.Sam {
+		cmds, err = syntax.CompileSam(args[0], output, copts...)
+	} else {
+		cmds, err = syntax.Compile(args[0], output, map[string]syntax.EvalMaker{
+			// the u command is a custom command that executes a shell command to
+			// perform the transformation.
+			"u": func(s string) (sregx.Evaluator, error) {
+				args, err := shellwords.Parse(s)
 				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
+					return nil, err
 				}
-				return out
-			}, nil
-		},
-	})
+
+				return func(b []byte) []byte {
+					cmd := exec.Command(args[0], args[1:]...)
+					inbuf := bytes.NewBuffer(b)
+					cmd.Stdin = inbuf
+					out, err := cmd.Output()
+					if err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+					return out
+				}, nil
+			},
+		}, copts...)
+	}
 	if err != nil {
 		var e syntax.MultiError
 		if errors.As(err, &e) {
@@ -137,9 +188,8 @@ func main() {
 		outputf = f
 	}
 
-	io.Copy(outputf, output)
-
 	out := cmds.Evaluate(data)
+	io.Copy(outputf, output)
 	if !hasP(cmds) {
 		_, err := outputf.Write(out)
 		must(err)
@@ -147,4 +197,7 @@ func main() {
 	if o, ok := outputf.(io.Closer); ok {
 		o.Close()
 	}
+	if failed {
+		os.Exit(1)
+	}
 }
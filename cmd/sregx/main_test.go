@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/zyedidia/sregx"
+	"github.com/zyedidia/sregx/syntax"
+)
+
+func TestHasP(t *testing.T) {
+	tests := []struct {
+		expr string
+		sam  bool
+		want bool
+	}{
+		{`x/a/ p`, false, true},
+		{`x/a/ c/b/`, false, false},
+		{`x/a/ count p`, false, true},
+		{`/x/=`, true, true},
+		{`/x/=#`, true, true},
+		{`,x/a/ c/b/`, true, false},
+	}
+
+	for _, tt := range tests {
+		var cmd sregx.Command
+		var err error
+		if tt.sam {
+			cmd, err = syntax.CompileSam(tt.expr, ioutil.Discard)
+		} else {
+			cmd, err = syntax.Compile(tt.expr, ioutil.Discard, nil)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		if got := hasP(cmd); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
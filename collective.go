@@ -0,0 +1,150 @@
+package sregx
+
+import (
+	"bytes"
+	"math/rand"
+	"regexp"
+	"sort"
+)
+
+// A Collective is a command that operates on all the selections of an X or Y
+// at once. When the command of an X or Y is a Collective, the selections are
+// passed to EvaluateAll and replaced, in order, with the returned slices.
+// Selections beyond the end of the returned list are deleted. The text between
+// the selections stays in place.
+type Collective interface {
+	Command
+	EvaluateAll(bs [][]byte) [][]byte
+}
+
+// Sort sorts the selections of an enclosing X or Y. Selections are compared by
+// their key, which is the first submatch of Key in the selection, or the whole
+// match if Key has no submatches, or the entire selection if Key is nil. If
+// Numeric is set, keys are compared as numbers and keys that are not numbers
+// sort before all numbers. If Fold is set, keys are compared
+// case-insensitively. If Reverse is set, the order is reversed. The sort is
+// stable.
+type Sort struct {
+	Key     *regexp.Regexp
+	Numeric bool
+	Fold    bool
+	Reverse bool
+}
+
+// Evaluate returns b, since a single selection is always sorted.
+func (s Sort) Evaluate(b []byte) []byte {
+	return b
+}
+
+// EvaluateAll returns the selections in sorted order.
+func (s Sort) EvaluateAll(bs [][]byte) [][]byte {
+	type item struct {
+		b   []byte
+		key []byte
+		num float64
+		ok  bool
+	}
+
+	items := make([]item, len(bs))
+	for i, b := range bs {
+		key := submatch(s.Key, b)
+		if s.Fold {
+			key = bytes.ToLower(key)
+		}
+		num, ok := parseNumber(key)
+		items[i] = item{b, key, num, ok && s.Numeric}
+	}
+
+	less := func(a, b item) bool {
+		if s.Numeric && (a.ok || b.ok) {
+			return !a.ok || b.ok && a.num < b.num
+		}
+		return bytes.Compare(a.key, b.key) < 0
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if s.Reverse {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
+
+	sorted := make([][]byte, len(items))
+	for i, it := range items {
+		sorted[i] = it.b
+	}
+	return sorted
+}
+
+// Uniq removes the selections of an enclosing X or Y whose key is equal to the
+// key of an earlier selection. Keys are determined as for Sort, and compared
+// case-insensitively if Fold is set.
+type Uniq struct {
+	Key  *regexp.Regexp
+	Fold bool
+}
+
+// Evaluate returns b, since a single selection is always unique.
+func (u Uniq) Evaluate(b []byte) []byte {
+	return b
+}
+
+// EvaluateAll returns the first selection with each key.
+func (u Uniq) EvaluateAll(bs [][]byte) [][]byte {
+	seen := make(map[string]bool)
+	uniq := make([][]byte, 0, len(bs))
+	for _, b := range bs {
+		key := submatch(u.Key, b)
+		if u.Fold {
+			key = bytes.ToLower(key)
+		}
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			uniq = append(uniq, b)
+		}
+	}
+	return uniq
+}
+
+// Reverse reverses the order of the selections of an enclosing X or Y.
+type Reverse struct{}
+
+// Evaluate returns b, since a single selection has only one order.
+func (r Reverse) Evaluate(b []byte) []byte {
+	return b
+}
+
+// EvaluateAll returns the selections in reverse order.
+func (r Reverse) EvaluateAll(bs [][]byte) [][]byte {
+	reversed := make([][]byte, len(bs))
+	for i, b := range bs {
+		reversed[len(bs)-1-i] = b
+	}
+	return reversed
+}
+
+// Shuffle randomly permutes the selections of an enclosing X or Y. The
+// permutation is drawn from Rand, or from the default source of math/rand if
+// Rand is nil. Seeding Rand makes the result reproducible.
+type Shuffle struct {
+	Rand *rand.Rand
+}
+
+// Evaluate returns b, since a single selection has only one order.
+func (s Shuffle) Evaluate(b []byte) []byte {
+	return b
+}
+
+// EvaluateAll returns the selections in a random order.
+func (s Shuffle) EvaluateAll(bs [][]byte) [][]byte {
+	shuffled := make([][]byte, len(bs))
+	copy(shuffled, bs)
+	swap := func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+	if s.Rand != nil {
+		s.Rand.Shuffle(len(shuffled), swap)
+	} else {
+		rand.Shuffle(len(shuffled), swap)
+	}
+	return shuffled
+}
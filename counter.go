@@ -0,0 +1,199 @@
+package sregx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Counter records the position of the current match while an X command
+// evaluates its matches. Commands nested inside the X may share its Counter to
+// refer to the match index in their text.
+type Counter struct {
+	// Index is the zero-based index of the current match.
+	Index int
+	// Count is the total number of matches.
+	Count int
+}
+
+// Expand returns a copy of template in which references to the counter have
+// been replaced with its values. The following references are recognized:
+//
+//	$#                   the index of the current match
+//	${#}                 the index of the current match
+//	${#:FMT}             the index formatted with the printf format FMT
+//	${#:FMT:START:STEP}  START + index*STEP formatted with FMT
+//	${##}                the total number of matches
+//	${##:FMT}            the total number of matches formatted with FMT
+//
+// An empty FMT means %d, and START and STEP may be omitted. FMT must hold
+// exactly one integer verb, such as %d or %x (see CheckCounter). For example
+// ${#:%03d:1} numbers matches 001, 002, and so on. The sequence $$ is copied
+// unchanged so that the result may be expanded again by regexp.Expand, and
+// $$# is therefore not a reference. If c is nil, template is returned as is.
+func (c *Counter) Expand(template []byte) []byte {
+	return c.expand(template, false)
+}
+
+// ExpandText is like Expand, but for text that is not expanded again, such as
+// that of C, A, or I: $$# and $${# become a literal $# and ${#, and any other $
+// is left as it is.
+func (c *Counter) ExpandText(template []byte) []byte {
+	return c.expand(template, true)
+}
+
+// expand implements Expand, and ExpandText if text is true.
+func (c *Counter) expand(template []byte, text bool) []byte {
+	if c == nil {
+		return template
+	}
+
+	dst := make([]byte, 0, len(template))
+	for {
+		i := bytes.IndexByte(template, '$')
+		if i < 0 || i == len(template)-1 {
+			break
+		}
+		dst = append(dst, template[:i]...)
+		template = template[i:]
+
+		switch template[1] {
+		case '$':
+			rest := template[2:]
+			if text && (bytes.HasPrefix(rest, []byte("#")) || bytes.HasPrefix(rest, []byte("{#"))) {
+				dst = append(dst, '$')
+			} else {
+				dst = append(dst, "$$"...)
+			}
+			template = template[2:]
+			continue
+		case '#':
+			dst = strconv.AppendInt(dst, int64(c.Index), 10)
+			template = template[2:]
+			continue
+		case '{':
+			end := bytes.IndexByte(template, '}')
+			if len(template) > 2 && template[2] == '#' && end >= 0 {
+				if spec, err := parseCounterSpec(string(template[3:end])); err == nil {
+					dst = append(dst, spec.format(c)...)
+					template = template[end+1:]
+					continue
+				}
+			}
+		}
+		dst = append(dst, '$')
+		template = template[1:]
+	}
+	return append(dst, template...)
+}
+
+// CheckCounter returns an error describing the first reference to a counter
+// in template that is not valid (see Counter.Expand), such as one whose
+// format is not for an integer.
+func CheckCounter(template []byte) error {
+	for {
+		i := bytes.Index(template, []byte("${#"))
+		if i < 0 {
+			return nil
+		}
+		// A $ escaped by another does not start a reference.
+		if n := len(template[:i]) - len(bytes.TrimRight(template[:i], "$")); n%2 == 1 {
+			template = template[i+1:]
+			continue
+		}
+		end := bytes.IndexByte(template[i:], '}')
+		if end < 0 {
+			return fmt.Errorf("unterminated counter reference %s", template[i:])
+		}
+		ref := template[i : i+end+1]
+		if _, err := parseCounterSpec(string(ref[3 : len(ref)-1])); err != nil {
+			return fmt.Errorf("invalid counter reference %s: %v", ref, err)
+		}
+		template = template[i+end+1:]
+	}
+}
+
+// A counterSpec is a parsed ${#...} reference.
+type counterSpec struct {
+	count  bool
+	layout string
+	start  int
+	step   int
+}
+
+// parseCounterSpec parses spec, which is the text of a ${#...} reference
+// following the first '#'.
+func parseCounterSpec(spec string) (counterSpec, error) {
+	cs := counterSpec{layout: "%d", step: 1}
+	cs.count = strings.HasPrefix(spec, "#")
+	if cs.count {
+		spec = spec[1:]
+	}
+	if spec == "" {
+		return cs, nil
+	}
+	if spec[0] != ':' {
+		return cs, errors.New("expected ':'")
+	}
+
+	fields := strings.Split(spec[1:], ":")
+	if len(fields) > 3 || cs.count && len(fields) > 1 {
+		return cs, errors.New("too many fields")
+	}
+	var err error
+	if len(fields) > 1 && fields[1] != "" {
+		if cs.start, err = strconv.Atoi(fields[1]); err != nil {
+			return cs, errors.New("start must be an integer")
+		}
+	}
+	if len(fields) > 2 && fields[2] != "" {
+		if cs.step, err = strconv.Atoi(fields[2]); err != nil {
+			return cs, errors.New("step must be an integer")
+		}
+	}
+	if fields[0] != "" {
+		if !intFormat(fields[0]) {
+			return cs, errors.New("format must have exactly one integer verb")
+		}
+		cs.layout = fields[0]
+	}
+	return cs, nil
+}
+
+// intFormat reports whether format is a printf format with exactly one verb,
+// which formats an integer.
+func intFormat(format string) bool {
+	verbs := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		// Flags, width, and precision.
+		for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+			i++
+		}
+		if i == len(format) {
+			return false
+		}
+		if format[i] == '%' {
+			continue
+		}
+		if strings.IndexByte("bcdoOqxXU", format[i]) < 0 {
+			return false
+		}
+		verbs++
+	}
+	return verbs == 1
+}
+
+// format formats the counter c as cs describes.
+func (cs counterSpec) format(c *Counter) string {
+	n := c.Count
+	if !cs.count {
+		n = cs.start + c.Index*cs.step
+	}
+	return fmt.Sprintf(cs.layout, n)
+}
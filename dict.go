@@ -0,0 +1,340 @@
+package sregx
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Dict is a mapping from keys to values that can find all occurrences of
+// its keys in a text in a single pass. It is built as an Aho-Corasick
+// automaton over the runes of the keys, so the time taken to search does not
+// depend on the number of keys.
+type Dict struct {
+	nodes  []dictNode
+	values [][]byte
+	depth  int // the length of the longest key in runes
+	fold   bool
+	word   bool
+}
+
+type dictNode struct {
+	next  map[rune]int
+	fail  int
+	out   int // the next node along the fail links that ends a key
+	key   int // the index of the value of the key ending here, or -1
+	depth int // the length of the key ending here in runes
+}
+
+// NewDict returns a Dict that maps each of keys to the value at the same
+// index in values, or to itself if values is nil. If a key occurs more than
+// once the last value is used, and empty keys are ignored. If fold is set,
+// keys match case-insensitively. If word is set, keys only match when they
+// are neither preceded nor followed by a letter, digit, or underscore.
+func NewDict(keys, values [][]byte, fold, word bool) *Dict {
+	d := &Dict{
+		nodes: []dictNode{{key: -1, out: -1}},
+		fold:  fold,
+		word:  word,
+	}
+
+	for i, k := range keys {
+		if len(k) == 0 {
+			continue
+		}
+		n := 0
+		for len(k) > 0 {
+			r, size := utf8.DecodeRune(k)
+			k = k[size:]
+			if fold {
+				r = foldRune(r)
+			}
+			next, ok := d.nodes[n].next[r]
+			if !ok {
+				if d.nodes[n].next == nil {
+					d.nodes[n].next = make(map[rune]int)
+				}
+				next = len(d.nodes)
+				d.nodes[n].next[r] = next
+				d.nodes = append(d.nodes, dictNode{
+					key:   -1,
+					out:   -1,
+					depth: d.nodes[n].depth + 1,
+				})
+			}
+			n = next
+		}
+		if d.nodes[n].depth > d.depth {
+			d.depth = d.nodes[n].depth
+		}
+		v := keys[i]
+		if values != nil {
+			v = values[i]
+		}
+		if d.nodes[n].key == -1 {
+			d.nodes[n].key = len(d.values)
+			d.values = append(d.values, v)
+		} else {
+			d.values[d.nodes[n].key] = v
+		}
+	}
+
+	// Compute the fail links breadth first, so that the links of shallower
+	// nodes are known when they are needed.
+	queue := []int{0}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for r, c := range d.nodes[u].next {
+			queue = append(queue, c)
+			if u == 0 {
+				continue
+			}
+			f := d.nodes[u].fail
+			for f != 0 && !d.has(f, r) {
+				f = d.nodes[f].fail
+			}
+			if next, ok := d.nodes[f].next[r]; ok {
+				f = next
+			}
+			d.nodes[c].fail = f
+			if d.nodes[f].key != -1 {
+				d.nodes[c].out = f
+			} else {
+				d.nodes[c].out = d.nodes[f].out
+			}
+		}
+	}
+	return d
+}
+
+// ReadDict reads a Dict from r, which holds one key and value per line
+// separated by comma. If comma is ',' the input is parsed as CSV, so that
+// fields may be quoted; otherwise lines are split at the first comma. Blank
+// lines and fields after the value are ignored. Fold and word are as for
+// NewDict.
+func ReadDict(r io.Reader, comma rune, fold, word bool) (*Dict, error) {
+	var keys, values [][]byte
+	add := func(where string, line int, fields []string) error {
+		if len(fields) == 1 && fields[0] == "" {
+			return nil
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s %d: expected a key and a value", where, line)
+		}
+		keys = append(keys, []byte(fields[0]))
+		values = append(values, []byte(fields[1]))
+		return nil
+	}
+
+	if comma == ',' {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		for record := 1; ; record++ {
+			fields, err := cr.Read()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if err := add("record", record, fields); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSuffix(scanner.Text(), "\r")
+			if err := add("line", line, strings.SplitN(text, string(comma), 3)); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return NewDict(keys, values, fold, word), nil
+}
+
+// ReadWords reads a Dict from r, which holds one key per line. Each key maps
+// to itself, so that the Dict may be used as a Matcher for a list of literal
+// strings. Blank lines are ignored. Fold and word are as for NewDict.
+func ReadWords(r io.Reader, fold, word bool) (*Dict, error) {
+	var keys [][]byte
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if key := bytes.TrimSuffix(scanner.Bytes(), []byte("\r")); len(key) > 0 {
+			keys = append(keys, append([]byte(nil), key...))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewDict(keys, nil, fold, word), nil
+}
+
+// Len returns the number of keys in d.
+func (d *Dict) Len() int {
+	return len(d.values)
+}
+
+// FindAllIndex returns the locations of the non-overlapping occurrences of
+// the keys of d in b. Where occurrences overlap, the leftmost is chosen, and of
+// those starting at the same place, the longest. A third element holds the
+// index of the value of the key, for use with Value. If n >= 0, at most n
+// locations are returned.
+func (d *Dict) FindAllIndex(b []byte, n int) [][]int {
+	var matches [][]int
+	// offs holds the byte offsets of the last runes read, which is as far back
+	// as a key can reach.
+	offs := make([]int, d.depth+1)
+	start := func(k, depth int) int {
+		return offs[(k-depth)%len(offs)]
+	}
+
+	// best is the leftmost-longest occurrence found since the last one was
+	// returned. It is returned once no occurrence that is yet to be found can
+	// start at or before it, and the search then resumes at its end.
+	var best []int
+	s, k := 0, 0
+	for i := 0; n < 0 || len(matches) < n; {
+		if i == len(b) {
+			if best == nil {
+				break
+			}
+			matches = append(matches, best)
+			i, s, best = best[1], 0, nil
+			continue
+		}
+
+		r, size := utf8.DecodeRune(b[i:])
+		if d.fold {
+			r = foldRune(r)
+		}
+		offs[k%len(offs)] = i
+		k++
+		i += size
+
+		for s != 0 && !d.has(s, r) {
+			s = d.nodes[s].fail
+		}
+		s = d.nodes[s].next[r]
+
+		// The first key along the out links is the longest ending here.
+		for m := s; m > 0; m = d.nodes[m].out {
+			if d.nodes[m].key == -1 {
+				continue
+			}
+			st := start(k, d.nodes[m].depth)
+			if d.word && !isWordBoundary(b, st, i) {
+				continue
+			}
+			if best == nil || st <= best[0] {
+				best = []int{st, i, d.nodes[m].key}
+			}
+			break
+		}
+
+		// Occurrences found later start no earlier than the text matched by s.
+		if best != nil && (s == 0 || start(k, d.nodes[s].depth) > best[0]) {
+			matches = append(matches, best)
+			i, s, best = best[1], 0, nil
+		}
+	}
+	return matches
+}
+
+// Match reports whether b contains a key of d. It stops reading b shortly
+// after the first occurrence.
+func (d *Dict) Match(b []byte) bool {
+	return d.FindAllIndex(b, 1) != nil
+}
+
+// Lookup returns the value of the key equal to the whole of b, and whether
+// there is one.
+func (d *Dict) Lookup(b []byte) ([]byte, bool) {
+	n := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		b = b[size:]
+		if d.fold {
+			r = foldRune(r)
+		}
+		next, ok := d.nodes[n].next[r]
+		if !ok {
+			return nil, false
+		}
+		n = next
+	}
+	if d.nodes[n].key == -1 {
+		return nil, false
+	}
+	return d.values[d.nodes[n].key], true
+}
+
+// Value returns the value with the given index, as found by FindAllIndex.
+func (d *Dict) Value(i int) []byte {
+	return d.values[i]
+}
+
+func (d *Dict) has(n int, r rune) bool {
+	_, ok := d.nodes[n].next[r]
+	return ok
+}
+
+// foldRune returns the smallest rune equivalent to r under Unicode simple
+// case folding, so that runes compare equal when they are equal up to case.
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// isWordBoundary reports whether b[start:end] is neither preceded nor
+// followed by a word character.
+func isWordBoundary(b []byte, start, end int) bool {
+	before, _ := utf8.DecodeLastRune(b[:start])
+	after, _ := utf8.DecodeRune(b[end:])
+	return !isWordRune(before) && !isWordRune(after)
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// M performs dictionary replacement. Every occurrence in the input of a key of
+// Dict is replaced with its value, and the rest of the input is left
+// unchanged. If Whole is set, as for the selections of an X, the input is
+// instead replaced only if it is a key as a whole.
+type M struct {
+	Dict  *Dict
+	Whole bool
+}
+
+// Evaluate replaces the keys of Dict in b with their values.
+func (m M) Evaluate(b []byte) []byte {
+	if m.Whole {
+		if v, ok := m.Dict.Lookup(b); ok {
+			return v
+		}
+		return b
+	}
+	matches := m.Dict.FindAllIndex(b, -1)
+	if matches == nil {
+		return b
+	}
+	return replaceAllIndex(b, matches, func(i int, _ []byte) []byte {
+		return m.Dict.Value(matches[i][2])
+	})
+}
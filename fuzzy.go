@@ -0,0 +1,112 @@
+package sregx
+
+import "unicode/utf8"
+
+// A Fuzzy is a Matcher that finds approximate occurrences of a pattern: the
+// substrings whose edit distance to the pattern, counting rune insertions,
+// deletions, and substitutions, is at most k. Matching uses Sellers' dynamic
+// programming algorithm, so it takes time proportional to the length of the
+// text times the length of the pattern.
+type Fuzzy struct {
+	patt []rune
+	k    int
+}
+
+// NewFuzzy returns a Fuzzy that matches substrings within edit distance k of
+// patt. Since a pattern of n runes is within distance n of the empty string, k
+// should be less than the length of patt in runes; otherwise it is reduced to
+// one less.
+func NewFuzzy(patt []byte, k int) *Fuzzy {
+	f := &Fuzzy{
+		patt: []rune(string(patt)),
+		k:    k,
+	}
+	if f.k >= len(f.patt) {
+		f.k = len(f.patt) - 1
+	}
+	return f
+}
+
+// Match reports whether b contains an approximate occurrence of the pattern.
+func (f *Fuzzy) Match(b []byte) bool {
+	return f.FindAllIndex(b, 1) != nil
+}
+
+// FindAllIndex returns the locations of the successive non-overlapping
+// approximate occurrences of the pattern in b. Once an occurrence is found, the
+// closest occurrence that overlaps it is chosen, and of those the one whose
+// length is nearest to that of the pattern. If n >= 0, at most n locations are
+// returned.
+func (f *Fuzzy) FindAllIndex(b []byte, n int) [][]int {
+	if len(f.patt) == 0 || f.k < 0 {
+		return nil
+	}
+
+	var matches [][]int
+	for pos := 0; pos < len(b) && (n < 0 || len(matches) < n); {
+		start, end, ok := f.next(b, pos)
+		if !ok {
+			break
+		}
+		matches = append(matches, []int{start, end})
+		pos = end
+	}
+	return matches
+}
+
+// next returns the location of the first approximate occurrence of the pattern
+// in b at or after from.
+func (f *Fuzzy) next(b []byte, from int) (int, int, bool) {
+	m := len(f.patt)
+	// cost[i] is the smallest distance between the first i runes of the
+	// pattern and a substring of b ending at the current position, and
+	// start[i] is where the closest such substring starts.
+	cost := make([]int, m+1)
+	start := make([]int, m+1)
+	prevCost := make([]int, m+1)
+	prevStart := make([]int, m+1)
+	for i := range cost {
+		cost[i], start[i] = i, from
+	}
+
+	best, bestDiff, bestStart, bestEnd := -1, 0, 0, 0
+	for pos := from; pos < len(b); {
+		r, size := utf8.DecodeRune(b[pos:])
+		pos += size
+
+		cost, prevCost = prevCost, cost
+		start, prevStart = prevStart, start
+		cost[0], start[0] = 0, pos
+		for i := 1; i <= m; i++ {
+			sub := prevCost[i-1]
+			if f.patt[i-1] != r {
+				sub++
+			}
+			cost[i], start[i] = sub, prevStart[i-1]
+			// On equal cost prefer the later start, for the shortest match.
+			if c := prevCost[i] + 1; c < cost[i] || c == cost[i] && prevStart[i] > start[i] {
+				cost[i], start[i] = c, prevStart[i]
+			}
+			if c := cost[i-1] + 1; c < cost[i] || c == cost[i] && start[i-1] > start[i] {
+				cost[i], start[i] = c, start[i-1]
+			}
+		}
+
+		if cost[m] <= f.k {
+			diff := utf8.RuneCount(b[start[m]:pos]) - m
+			if diff < 0 {
+				diff = -diff
+			}
+			better := cost[m] < best || cost[m] == best && diff < bestDiff
+			if best == -1 || start[m] < bestEnd && better {
+				best, bestDiff, bestStart, bestEnd = cost[m], diff, start[m], pos
+			}
+		}
+		// An occurrence starting at or before bestStart is at most m+k runes
+		// long, so beyond that there is no closer one to find.
+		if best == 0 || best != -1 && utf8.RuneCount(b[bestStart:pos]) >= m+f.k {
+			break
+		}
+	}
+	return bestStart, bestEnd, best != -1
+}
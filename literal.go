@@ -0,0 +1,54 @@
+package sregx
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// A Literal is a Matcher that finds occurrences of a fixed string, with no
+// metacharacters. It uses bytes.Index, which is much faster than a regular
+// expression for the same string.
+type Literal struct {
+	s []byte
+}
+
+// NewLiteral returns a Literal that matches s.
+func NewLiteral(s []byte) *Literal {
+	return &Literal{
+		s: s,
+	}
+}
+
+// Match reports whether b contains the string.
+func (l *Literal) Match(b []byte) bool {
+	return bytes.Contains(b, l.s)
+}
+
+// FindAllIndex returns the locations of the successive non-overlapping
+// occurrences of the string in b. As for a regular expression, the empty string
+// matches at every rune boundary. If n >= 0, at most n locations are returned.
+func (l *Literal) FindAllIndex(b []byte, n int) [][]int {
+	var matches [][]int
+	for pos := 0; pos <= len(b) && (n < 0 || len(matches) < n); {
+		i := bytes.Index(b[pos:], l.s)
+		if i == -1 {
+			break
+		}
+		start, end := pos+i, pos+i+len(l.s)
+		matches = append(matches, []int{start, end})
+		if end > start {
+			pos = end
+		} else if start < len(b) {
+			_, size := utf8.DecodeRune(b[start:])
+			pos = start + size
+		} else {
+			break
+		}
+	}
+	return matches
+}
+
+// String returns the string that l matches.
+func (l *Literal) String() string {
+	return string(l.s)
+}
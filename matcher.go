@@ -0,0 +1,36 @@
+package sregx
+
+import "regexp"
+
+// A Matcher finds the selections of an X or Y and tests the condition of a G
+// or V. A *regexp.Regexp is a Matcher, as are a *Literal, a *Dict, and a
+// *Fuzzy.
+type Matcher interface {
+	// Match reports whether b contains a match.
+	Match(b []byte) bool
+	// FindAllIndex returns the locations of the successive non-overlapping
+	// matches in b, as regexp.Regexp.FindAllIndex does. If n >= 0, at most n
+	// locations are returned.
+	FindAllIndex(b []byte, n int) [][]int
+}
+
+// A Submatcher is a Matcher that also finds submatches, and can expand
+// templates that refer to them, as a *regexp.Regexp can. The S command expands
+// its replacement for a Submatcher.
+type Submatcher interface {
+	Matcher
+	// FindAllSubmatchIndex returns the locations of the successive
+	// non-overlapping matches in b and of their submatches, as
+	// regexp.Regexp.FindAllSubmatchIndex does.
+	FindAllSubmatchIndex(b []byte, n int) [][]int
+	// Expand appends template to dst with the variables in it replaced by
+	// the submatches of src given by match, as regexp.Regexp.Expand does.
+	Expand(dst []byte, template []byte, src []byte, match []int) []byte
+}
+
+var _ Matcher = (*regexp.Regexp)(nil)
+var _ Matcher = (*Literal)(nil)
+var _ Matcher = (*Dict)(nil)
+var _ Matcher = (*Fuzzy)(nil)
+
+var _ Submatcher = (*regexp.Regexp)(nil)
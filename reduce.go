@@ -0,0 +1,200 @@
+package sregx
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// A Reducer is a command that folds all the selections of an X or Y into a
+// single result. When the command of an X or Y is a Reducer, the region from
+// the start of the first selection to the end of the last one is replaced with
+// the return value of Reduce. If there are no selections, the input is left
+// unchanged.
+//
+// The reducers in this package evaluate their result using Cmd if it is
+// non-nil, so that for example the result may be printed. On their own, they
+// treat the input as a single selection.
+type Reducer interface {
+	Command
+	Reduce(bs [][]byte) []byte
+}
+
+// Count counts the selections of an enclosing X or Y.
+type Count struct {
+	Cmd Command
+}
+
+// Evaluate returns the count of a single selection.
+func (c Count) Evaluate(b []byte) []byte {
+	return c.Reduce([][]byte{b})
+}
+
+// Reduce returns the number of selections.
+func (c Count) Reduce(bs [][]byte) []byte {
+	return then(c.Cmd, []byte(strconv.Itoa(len(bs))))
+}
+
+// Sum adds up the numeric selections of an enclosing X or Y. If Key is
+// non-nil, the number is taken from its first submatch in each selection (or
+// its whole match if it has no submatches). Selections that are not numbers
+// are ignored.
+type Sum struct {
+	Key *regexp.Regexp
+	Cmd Command
+}
+
+// Evaluate returns the sum of a single selection.
+func (s Sum) Evaluate(b []byte) []byte {
+	return s.Reduce([][]byte{b})
+}
+
+// Reduce returns the sum of the selections.
+func (s Sum) Reduce(bs [][]byte) []byte {
+	sum := 0.0
+	for _, b := range bs {
+		if f, ok := parseNumber(submatch(s.Key, b)); ok {
+			sum += f
+		}
+	}
+	return then(s.Cmd, formatNumber(sum))
+}
+
+// Avg averages the numeric selections of an enclosing X or Y. Key is used as
+// for Sum. If no selection is a number the result is empty.
+type Avg struct {
+	Key *regexp.Regexp
+	Cmd Command
+}
+
+// Evaluate returns the average of a single selection.
+func (a Avg) Evaluate(b []byte) []byte {
+	return a.Reduce([][]byte{b})
+}
+
+// Reduce returns the average of the selections.
+func (a Avg) Reduce(bs [][]byte) []byte {
+	sum, n := 0.0, 0
+	for _, b := range bs {
+		if f, ok := parseNumber(submatch(a.Key, b)); ok {
+			sum += f
+			n++
+		}
+	}
+	if n == 0 {
+		return then(a.Cmd, []byte{})
+	}
+	return then(a.Cmd, formatNumber(sum/float64(n)))
+}
+
+// Min selects the numerically smallest selection of an enclosing X or Y. Key
+// is used as for Sum. The result is the entire selection, or empty if no
+// selection is a number.
+type Min struct {
+	Key *regexp.Regexp
+	Cmd Command
+}
+
+// Evaluate returns b if it is a number.
+func (m Min) Evaluate(b []byte) []byte {
+	return m.Reduce([][]byte{b})
+}
+
+// Reduce returns the smallest selection.
+func (m Min) Reduce(bs [][]byte) []byte {
+	return then(m.Cmd, extreme(m.Key, bs, func(a, b float64) bool {
+		return a < b
+	}))
+}
+
+// Max selects the numerically largest selection of an enclosing X or Y. Key
+// is used as for Sum. The result is the entire selection, or empty if no
+// selection is a number.
+type Max struct {
+	Key *regexp.Regexp
+	Cmd Command
+}
+
+// Evaluate returns b if it is a number.
+func (m Max) Evaluate(b []byte) []byte {
+	return m.Reduce([][]byte{b})
+}
+
+// Reduce returns the largest selection.
+func (m Max) Reduce(bs [][]byte) []byte {
+	return then(m.Cmd, extreme(m.Key, bs, func(a, b float64) bool {
+		return a > b
+	}))
+}
+
+// Longest selects the longest selection of an enclosing X or Y. Of several
+// selections with the same length, the first is chosen.
+type Longest struct {
+	Cmd Command
+}
+
+// Evaluate returns b.
+func (l Longest) Evaluate(b []byte) []byte {
+	return l.Reduce([][]byte{b})
+}
+
+// Reduce returns the longest selection.
+func (l Longest) Reduce(bs [][]byte) []byte {
+	longest := []byte{}
+	for i, b := range bs {
+		if i == 0 || len(b) > len(longest) {
+			longest = b
+		}
+	}
+	return then(l.Cmd, longest)
+}
+
+// Shortest selects the shortest selection of an enclosing X or Y. Of several
+// selections with the same length, the first is chosen.
+type Shortest struct {
+	Cmd Command
+}
+
+// Evaluate returns b.
+func (s Shortest) Evaluate(b []byte) []byte {
+	return s.Reduce([][]byte{b})
+}
+
+// Reduce returns the shortest selection.
+func (s Shortest) Reduce(bs [][]byte) []byte {
+	shortest := []byte{}
+	for i, b := range bs {
+		if i == 0 || len(b) < len(shortest) {
+			shortest = b
+		}
+	}
+	return then(s.Cmd, shortest)
+}
+
+// extreme returns the first numeric selection whose key is better than those
+// of all the others, or an empty slice if there are no numeric selections.
+func extreme(key *regexp.Regexp, bs [][]byte, better func(a, b float64) bool) []byte {
+	var best []byte
+	var bestf float64
+	for _, b := range bs {
+		f, ok := parseNumber(submatch(key, b))
+		if ok && (best == nil || better(f, bestf)) {
+			best, bestf = b, f
+		}
+	}
+	if best == nil {
+		return []byte{}
+	}
+	return best
+}
+
+// then evaluates b using cmd, or returns b if cmd is nil.
+func then(cmd Command, b []byte) []byte {
+	if cmd == nil {
+		return b
+	}
+	return cmd.Evaluate(b)
+}
+
+func formatNumber(f float64) []byte {
+	return strconv.AppendFloat(nil, f, 'f', -1, 64)
+}
@@ -2,6 +2,8 @@ package sregx
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"regexp"
 )
@@ -25,31 +27,61 @@ func (cp CommandPipeline) Evaluate(b []byte) []byte {
 }
 
 // X performs extraction. On every match of Patt in the input it replaces the
-// match with the output of evaluating Cmd on the match.
+// match with the output of evaluating Cmd on the match. If Cmd is a
+// Collective or a Reducer, all the matches are evaluated together instead. If
+// Select is non-empty, only the matches whose index is selected by one of its
+// ranges are evaluated and the others are left unchanged. If Counter is
+// non-nil, it is updated with the index of each evaluated match before Cmd is
+// evaluated on it.
 type X struct {
-	Patt *regexp.Regexp
-	Cmd  Command
+	Patt    Matcher
+	Cmd     Command
+	Select  []Range
+	Counter *Counter
 }
 
 // Evaluate replaces all parts of b that are matched by Patt with the
 // application of Cmd to those substrings.
 func (x X) Evaluate(b []byte) []byte {
-	return x.Patt.ReplaceAllFunc(b, func(b []byte) []byte {
+	matches := selectIndex(x.Select, x.Patt.FindAllIndex(b, -1))
+	switch cmd := x.Cmd.(type) {
+	case Reducer:
+		return reduce(cmd, b, matches)
+	case Collective:
+		return evaluateAll(cmd, b, matches)
+	}
+	if x.Counter != nil {
+		x.Counter.Count = len(matches)
+	}
+	return replaceAllIndex(b, matches, func(i int, b []byte) []byte {
+		if x.Counter != nil {
+			x.Counter.Index = i
+		}
 		return x.Cmd.Evaluate(b)
 	})
 }
 
 // Y performs complement extraction. It is the same as X but extracts the
-// pieces in the source between Patt and applies Cmd to those.
+// pieces in the source between Patt and applies Cmd to those (or to all of
+// them together if Cmd is a Collective or a Reducer). If Select is non-empty,
+// only the pieces whose index is selected by one of its ranges are evaluated.
 type Y struct {
-	Patt *regexp.Regexp
-	Cmd  Command
+	Patt   Matcher
+	Cmd    Command
+	Select []Range
 }
 
 // Evaluate replaces all parts of b that aren't matched by Patt with the
 // application of Cmd to those substrings.
 func (y Y) Evaluate(b []byte) []byte {
-	return ReplaceAllComplementFunc(y.Patt, b, func(b []byte) []byte {
+	pieces := selectIndex(y.Select, complementIndex(y.Patt.FindAllIndex(b, -1), len(b)))
+	switch cmd := y.Cmd.(type) {
+	case Reducer:
+		return reduce(cmd, b, pieces)
+	case Collective:
+		return evaluateAll(cmd, b, pieces)
+	}
+	return replaceAllIndex(b, pieces, func(i int, b []byte) []byte {
 		return y.Cmd.Evaluate(b)
 	})
 }
@@ -57,7 +89,7 @@ func (y Y) Evaluate(b []byte) []byte {
 // G performs conditional evaluation. If Patt matches the input, the entire
 // input text is evaluated using Cmd (not just the part that matched).
 type G struct {
-	Patt *regexp.Regexp
+	Patt Matcher
 	Cmd  Command
 }
 
@@ -72,7 +104,7 @@ func (g G) Evaluate(b []byte) []byte {
 // V performs complement conditional evaluation. If Patt does not match the
 // input text the entire input is evaluated using Cmd.
 type V struct {
-	Patt *regexp.Regexp
+	Patt Matcher
 	Cmd  Command
 }
 
@@ -84,17 +116,166 @@ func (v V) Evaluate(b []byte) []byte {
 	return b
 }
 
+// A Cond is a condition on a number.
+type Cond func(f float64) bool
+
+// GNum performs numeric conditional evaluation. If the input parses as a
+// number that satisfies Cond, the entire input is evaluated using Cmd. If Key
+// is non-nil, the number is taken from its first submatch in the input (or its
+// whole match if it has no submatches) instead.
+type GNum struct {
+	Cond Cond
+	Key  *regexp.Regexp
+	Cmd  Command
+}
+
+// Evaluate applies Cmd if b is a number satisfying Cond.
+func (g GNum) Evaluate(b []byte) []byte {
+	if f, ok := parseNumber(submatch(g.Key, b)); ok && g.Cond(f) {
+		return g.Cmd.Evaluate(b)
+	}
+	return b
+}
+
+// VNum performs complement numeric conditional evaluation. If the input is not
+// a number that satisfies Cond, the entire input is evaluated using Cmd. Key is
+// used as for GNum.
+type VNum struct {
+	Cond Cond
+	Key  *regexp.Regexp
+	Cmd  Command
+}
+
+// Evaluate applies Cmd if b is not a number satisfying Cond.
+func (v VNum) Evaluate(b []byte) []byte {
+	if f, ok := parseNumber(submatch(v.Key, b)); !ok || !v.Cond(f) {
+		return v.Cmd.Evaluate(b)
+	}
+	return b
+}
+
+// A Case is a single arm of a Switch. If Patt matches the input, Cmd is used
+// to evaluate it.
+type Case struct {
+	Patt Matcher
+	Cmd  Command
+}
+
+// Switch performs first-match-wins conditional evaluation. The input is
+// evaluated using the command of the first case whose pattern matches it. If
+// no case matches, the input is evaluated using Default, or returned without
+// modification if Default is nil.
+type Switch struct {
+	Cases   []Case
+	Default Command
+}
+
+// Evaluate applies the command of the first matching case to b.
+func (s Switch) Evaluate(b []byte) []byte {
+	for _, c := range s.Cases {
+		if c.Patt.Match(b) {
+			return c.Cmd.Evaluate(b)
+		}
+	}
+	if s.Default != nil {
+		return s.Default.Evaluate(b)
+	}
+	return b
+}
+
+// ErrLoopLimit is reported by Loop when it reaches its iteration limit before
+// the output stops changing.
+var ErrLoopLimit = errors.New("loop: iteration limit reached")
+
+// Loop performs repeated evaluation. Cmd is applied to the input and then to
+// its own output until the output is identical to the input, or until Max
+// iterations have been performed, in which case ErrLoopLimit is reported to
+// Err. A Max of zero means there is no iteration limit.
+type Loop struct {
+	Cmd Command
+	Max int
+	Err ErrorHandler
+}
+
+// Evaluate applies Cmd to b until a fixpoint or the iteration limit is
+// reached.
+func (l Loop) Evaluate(b []byte) []byte {
+	for i := 0; l.Max <= 0 || i < l.Max; i++ {
+		next := l.Cmd.Evaluate(b)
+		if bytes.Equal(next, b) {
+			return next
+		}
+		b = next
+	}
+	l.Err.report(fmt.Errorf("%w after %d iterations", ErrLoopLimit, l.Max))
+	return b
+}
+
 // S performs substitution. All occurrences of Patt in the input are replaced
-// with Replace. Inside Replace, $ signs are expanded so for instance $1
-// represents the text of the first submatch.
+// with Replace. If Patt is a Submatcher, such as a *regexp.Regexp, $ signs
+// inside Replace are expanded so for instance $1 represents the text of the
+// first submatch, and case modifiers may be used:
+//
+//	\U  uppercase the text that follows, up to \E or another \U or \L
+//	\L  lowercase the text that follows, up to \E or another \U or \L
+//	\E  end the effect of \U or \L
+//	\u  uppercase the next character
+//	\l  lowercase the next character
+//	\\  a backslash, which does not begin a case modifier
+//
+// A backslash followed by any other character is copied unchanged. For other
+// Matchers, such as a *Literal, Replace is used as it is. If Counter is
+// non-nil, references to it are expanded first (see Counter.Expand). If
+// PreserveCase is set, the case of each match is applied to its replacement
+// (see MatchCase); Patt is then usually case-insensitive. If Select is
+// non-empty, only the occurrences whose index is selected by one of its ranges
+// are replaced. If Err is non-nil and nothing is replaced, an error wrapping
+// ErrNoMatch is reported to it.
 type S struct {
-	Patt    *regexp.Regexp
-	Replace []byte
+	Patt         Matcher
+	Replace      []byte
+	Counter      *Counter
+	PreserveCase bool
+	Select       []Range
+	Err          ErrorHandler
 }
 
+// ErrNoMatch is reported by an S with an error handler when it replaces
+// nothing.
+var ErrNoMatch = errors.New("no match")
+
 // Evaluate performs substitution on b.
 func (s S) Evaluate(b []byte) []byte {
-	return s.Patt.ReplaceAll(b, s.Replace)
+	template := s.Counter.Expand(s.Replace)
+	sm, isSub := s.Patt.(Submatcher)
+	modified := isSub && hasCaseModifier(template)
+	if re, ok := s.Patt.(*regexp.Regexp); ok && !s.PreserveCase && !modified && len(s.Select) == 0 && s.Err == nil {
+		return re.ReplaceAll(b, template)
+	}
+
+	var matches [][]int
+	if isSub {
+		matches = sm.FindAllSubmatchIndex(b, -1)
+	} else {
+		matches = s.Patt.FindAllIndex(b, -1)
+	}
+	matches = selectIndex(s.Select, matches)
+	if len(matches) == 0 {
+		s.Err.report(fmt.Errorf("%w for /%s/", ErrNoMatch, s.Patt))
+		return b
+	}
+	return replaceAllIndex(b, matches, func(i int, match []byte) []byte {
+		repl := template
+		if modified {
+			repl = expandCase(sm, template, b, matches[i])
+		} else if isSub {
+			repl = sm.Expand(nil, template, b, matches[i])
+		}
+		if s.PreserveCase {
+			repl = MatchCase(match, repl)
+		}
+		return repl
+	})
 }
 
 // P writes the input to W.
@@ -117,26 +298,105 @@ func (d D) Evaluate(b []byte) []byte {
 }
 
 // C performs changes. No matter the input, it always returns the Change slice.
+// If Counter is non-nil, references to it in Change are expanded (see
+// Counter.ExpandText).
 type C struct {
-	Change []byte
+	Change  []byte
+	Counter *Counter
 }
 
 // Evaluate returns Change.
 func (c C) Evaluate(b []byte) []byte {
-	return c.Change
+	return c.Counter.ExpandText(c.Change)
+}
+
+// A performs appending. It returns the input followed by Text. If Counter is
+// non-nil, references to it in Text are expanded (see Counter.ExpandText).
+type A struct {
+	Text    []byte
+	Counter *Counter
+}
+
+// Evaluate returns b with Text appended.
+func (a A) Evaluate(b []byte) []byte {
+	text := a.Counter.ExpandText(a.Text)
+	dst := make([]byte, 0, len(b)+len(text))
+	dst = append(dst, b...)
+	return append(dst, text...)
+}
+
+// I performs insertion. It returns Text followed by the input. If Counter is
+// non-nil, references to it in Text are expanded (see Counter.ExpandText).
+type I struct {
+	Text    []byte
+	Counter *Counter
+}
+
+// Evaluate returns b with Text inserted before it.
+func (i I) Evaluate(b []byte) []byte {
+	text := i.Counter.ExpandText(i.Text)
+	dst := make([]byte, 0, len(b)+len(text))
+	dst = append(dst, text...)
+	return append(dst, b...)
+}
+
+// A Range selects the indices from Start up to but not including End of a
+// sequence, in steps of Step. As with N, negative values of Start and End
+// refer to offsets from the end of the sequence, so -1 is the end itself. A
+// Step less than 1 is the same as a Step of 1.
+type Range struct {
+	Start int
+	End   int
+	Step  int
+}
+
+// Contains reports whether r selects index i of a sequence of length n.
+func (r Range) Contains(i, n int) bool {
+	start, end := r.bounds(n)
+	step := r.Step
+	if step < 1 {
+		step = 1
+	}
+	return i >= start && i < end && (i-start)%step == 0
+}
+
+// bounds returns the start and end indices of r in a sequence of length n.
+func (r Range) bounds(n int) (int, int) {
+	start, end := r.Start, r.End
+	if start < 0 {
+		start = n + 1 + start
+	}
+	if end < 0 {
+		end = n + 1 + end
+	}
+	return clamp(start, 0, n), clamp(end, 0, n)
 }
 
 // N extracts a slice of the input and replaces that slice with the return
 // value of Cmd evaluated on it.
+//
+// If Ranges is non-empty, Start and End are ignored and Cmd is applied to each
+// piece of the input selected by Ranges instead (or to all of them together if
+// Cmd is a Collective or a Reducer), as X does. A range with a step greater
+// than 1 selects each byte in its steps as a piece, and any other range is a
+// single piece. Pieces that overlap are merged.
 type N struct {
-	Start int
-	End   int
-	Cmd   Command
+	Start  int
+	End    int
+	Cmd    Command
+	Ranges []Range
 }
 
 // Evaluate calculates slices the input with [start:end] and replaces that part
 // of the input with the application of Cmd to it.
 func (n N) Evaluate(b []byte) []byte {
+	if len(n.Ranges) > 0 {
+		matches := pieces(n.Ranges, len(b), func(i int) int {
+			return i
+		})
+		return evaluatePieces(n.Cmd, b, matches)
+	}
+
 	if n.Start < 0 {
 		n.Start = len(b) + 1 + n.Start
 	}
@@ -145,22 +405,54 @@ func (n N) Evaluate(b []byte) []byte {
 	}
 
 	n.Start = clamp(n.Start, 0, len(b))
-	n.End = clamp(n.End, 0, len(b))
+	n.End = clamp(n.End, n.Start, len(b))
 
 	return ReplaceSlice(b, n.Start, n.End, n.Cmd.Evaluate(b[n.Start:n.End]))
 }
 
 // L extracts a slice of lines from the input and replaces that slice with the
 // return value of Cmd evaluated on it.
+//
+// If StartPatt or EndPatt is non-nil, L instead selects every block of lines
+// bounded by them, as awk's /a/,/b/ ranges do, and applies Cmd to each block
+// (or to all of them together if Cmd is a Collective or a Reducer). A block
+// starts with a line that contains a match of StartPatt, and ends with the
+// next line, which may be the same one, that contains a match of EndPatt, or
+// at the end of the input if there is none. If EndPatt is nil, the block ends
+// End lines after the line that starts it instead, and if StartPatt is nil, it
+// starts -Start lines before the line that ends it. Blocks do not overlap.
+//
+// Otherwise, if Ranges is non-empty, Start and End are ignored and Cmd is
+// applied to each piece selected by Ranges, as for N but counting lines.
 type L struct {
-	Start int
-	End   int
-	Cmd   Command
+	Start     int
+	End       int
+	Cmd       Command
+	StartPatt Matcher
+	EndPatt   Matcher
+	Ranges    []Range
 }
 
 // Evaluate calculates the offsets for the line range Start:End and replaces
 // that part of the input with the application of Cmd to it.
 func (l L) Evaluate(b []byte) []byte {
+	if l.StartPatt != nil || l.EndPatt != nil {
+		return evaluatePieces(l.Cmd, b, l.blocks(b))
+	}
+	if len(l.Ranges) > 0 {
+		// starts holds the offset of each line that follows a newline.
+		starts := []int{0}
+		for i, c := range b {
+			if c == '\n' {
+				starts = append(starts, i+1)
+			}
+		}
+		matches := pieces(l.Ranges, len(starts)-1, func(i int) int {
+			return starts[i]
+		})
+		return evaluatePieces(l.Cmd, b, matches)
+	}
+
 	if l.Start < 0 || l.End < 0 {
 		nlines := bytes.Count(b, []byte{'\n'})
 		if l.Start < 0 {
@@ -175,14 +467,75 @@ func (l L) Evaluate(b []byte) []byte {
 	end := IndexN(b, []byte{'\n'}, l.End) + 1
 
 	start = clamp(start, 0, len(b))
-	end = clamp(end, 0, len(b))
+	end = clamp(end, start, len(b))
 
 	return ReplaceSlice(b, start, end, l.Cmd.Evaluate(b[start:end]))
 }
 
+// blocks returns the locations of the blocks of lines of b bounded by
+// StartPatt and EndPatt.
+func (l L) blocks(b []byte) [][]int {
+	var lines [][]int
+	for start := 0; start < len(b); {
+		end := bytes.IndexByte(b[start:], '\n') + start + 1
+		if end == start {
+			end = len(b)
+		}
+		lines = append(lines, []int{start, end})
+		start = end
+	}
+	// next returns the index of the first line from i on that contains a
+	// match of patt, or len(lines) if there is none. A line is matched
+	// without its newline, so that $ matches at its end.
+	next := func(patt Matcher, i int) int {
+		for ; i < len(lines); i++ {
+			if patt.Match(bytes.TrimSuffix(b[lines[i][0]:lines[i][1]], []byte{'\n'})) {
+				break
+			}
+		}
+		return i
+	}
+
+	var blocks [][]int
+	for i := 0; i < len(lines); {
+		var first, last int
+		if l.StartPatt != nil {
+			first = next(l.StartPatt, i)
+			if first == len(lines) {
+				break
+			}
+			if l.EndPatt != nil {
+				last = clamp(next(l.EndPatt, first), first, len(lines)-1)
+			} else {
+				last = clamp(first+l.End, first, len(lines)-1)
+			}
+		} else {
+			last = next(l.EndPatt, i)
+			if last == len(lines) {
+				break
+			}
+			first = clamp(last+l.Start, i, last)
+		}
+		blocks = append(blocks, []int{lines[first][0], lines[last][1]})
+		i = last + 1
+	}
+	return blocks
+}
+
 // Evaluator is a function that performs a transformation.
 type Evaluator func(b []byte) []byte
 
+// An ErrorHandler is called when a command encounters an error during
+// evaluation. Evaluation does not stop: the command recovers as described in
+// its documentation once the handler returns.
+type ErrorHandler func(err error)
+
+func (h ErrorHandler) report(err error) {
+	if h != nil {
+		h(err)
+	}
+}
+
 // U is a user-defined command. The user provides the evaluator function that
 // is used to perform the transformation.
 type U struct {
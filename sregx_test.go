@@ -2,7 +2,9 @@ package sregx_test
 
 import (
 	"bytes"
+	"errors"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/zyedidia/sregx"
@@ -139,3 +141,682 @@ func TestICapitalizeAlternate(t *testing.T) {
 
 	check(cmd, tests, t)
 }
+
+func TestSwitch(t *testing.T) {
+	// x/[a-zA-Z0-9]+/ switch { /^[0-9]+$/ c/N/; /^[A-Z]/ c/U/; default d }
+	cmd := sregx.X{
+		Patt: regexp.MustCompile("[a-zA-Z0-9]+"),
+		Cmd: sregx.Switch{
+			Cases: []sregx.Case{
+				{Patt: regexp.MustCompile("^[0-9]+$"), Cmd: sregx.C{Change: []byte("N")}},
+				{Patt: regexp.MustCompile("^[A-Z]"), Cmd: sregx.C{Change: []byte("U")}},
+			},
+			Default: sregx.D{},
+		},
+	}
+
+	tests := []Test{
+		{"switch1", "12 Abc def 3x", "N U  "},
+		{"switch2", "A1 99", "U N"},
+	}
+
+	check(cmd, tests, t)
+}
+
+func TestLoop(t *testing.T) {
+	// loop { s/\(\)// }
+	cmd := sregx.Loop{
+		Cmd: sregx.S{
+			Patt:    regexp.MustCompile(`\(\)`),
+			Replace: []byte(""),
+		},
+	}
+
+	tests := []Test{
+		{"loop1", "((()))x(())", "x"},
+		{"loop2", "nothing", "nothing"},
+	}
+
+	check(cmd, tests, t)
+
+	var errs []error
+	limited := sregx.Loop{
+		Cmd: sregx.S{
+			Patt:    regexp.MustCompile(`a`),
+			Replace: []byte("aa"),
+		},
+		Max: 3,
+		Err: func(err error) {
+			errs = append(errs, err)
+		},
+	}
+	check(limited, []Test{{"limit", "a", "aaaaaaaa"}}, t)
+	if len(errs) != 1 || !errors.Is(errs[0], sregx.ErrLoopLimit) {
+		t.Errorf("got errors %v, want ErrLoopLimit", errs)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	// x/case/ c/case ${#:%02d:1}:/
+	counter := &sregx.Counter{}
+	cmd := sregx.X{
+		Patt: regexp.MustCompile("case"),
+		Cmd: sregx.C{
+			Change:  []byte("case ${#:%02d:1} of ${##}:"),
+			Counter: counter,
+		},
+		Counter: counter,
+	}
+
+	tests := []Test{
+		{"counter1", "case case case", "case 01 of 3: case 02 of 3: case 03 of 3:"},
+		{"counter2", "none", "none"},
+	}
+
+	check(cmd, tests, t)
+
+	expand := []Test{
+		{"expand1", "$#", "4"},
+		{"expand2", "${#:%x:10:-1}", "6"},
+		{"expand3", "$$# ${x} $", "$$# ${x} $"},
+		{"expand4", "${#:%d:a}", "${#:%d:a}"},
+	}
+	c := &sregx.Counter{Index: 4, Count: 5}
+	for _, tt := range expand {
+		t.Run(tt.name, func(t *testing.T) {
+			if out := c.Expand([]byte(tt.input)); string(out) != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+	if out := c.ExpandText([]byte("$$# $${#} $$$# $$ $1")); string(out) != "$# ${#} $$4 $$ $1" {
+		t.Errorf("got %q, want %q", out, "$# ${#} $$4 $$ $1")
+	}
+
+	checks := []struct {
+		template string
+		valid    bool
+	}{
+		{"cost: ${#:%%%03d} $${#:%s}", true},
+		{"${#:%s}", false},
+		{"${#:%d %x}", false},
+		{"${#:%d:a}", false},
+		{"${#", false},
+	}
+	for _, tt := range checks {
+		if err := sregx.CheckCounter([]byte(tt.template)); tt.valid != (err == nil) {
+			t.Errorf("%s: got error %v", tt.template, err)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	// x/a/[1:-1:2] c/b/
+	cmd := sregx.X{
+		Patt:   regexp.MustCompile("a"),
+		Cmd:    sregx.C{Change: []byte("b")},
+		Select: []sregx.Range{{Start: 1, End: -1, Step: 2}},
+	}
+
+	tests := []Test{
+		{"select1", "aaaaaa", "ababab"},
+		{"select2", "a", "a"},
+	}
+
+	check(cmd, tests, t)
+
+	// y/,/[-2:-1] c/last/
+	ycmd := sregx.Y{
+		Patt:   regexp.MustCompile(","),
+		Cmd:    sregx.C{Change: []byte("last")},
+		Select: []sregx.Range{{Start: -2, End: -1}},
+	}
+
+	check(ycmd, []Test{
+		{"yselect1", "a,b,c", "a,b,last"},
+		{"yselect2", "a,b,", "a,b,last"},
+	}, t)
+}
+
+func TestCollective(t *testing.T) {
+	lines := regexp.MustCompile(`.*\n`)
+
+	tests := []struct {
+		name  string
+		cmd   sregx.Command
+		input string
+		want  string
+	}{
+		{"sort", sregx.Sort{}, "b\nc\na\n", "a\nb\nc\n"},
+		{"sortnum", sregx.Sort{Numeric: true}, "10\nx\n9\n", "x\n9\n10\n"},
+		{"sortkey", sregx.Sort{Key: regexp.MustCompile(`=(.*)`), Reverse: true}, "a=1\nb=3\nc=2\n", "b=3\nc=2\na=1\n"},
+		{"sortfold", sregx.Sort{Fold: true}, "b\nA\nC\n", "A\nb\nC\n"},
+		{"uniq", sregx.Uniq{Fold: true}, "a\nb\nA\nb\nc\n", "a\nb\nc\n"},
+		{"reverse", sregx.Reverse{}, "a\nb\nc\n", "c\nb\na\n"},
+	}
+
+	for _, tt := range tests {
+		check(sregx.X{Patt: lines, Cmd: tt.cmd}, []Test{{tt.name, tt.input, tt.want}}, t)
+	}
+
+	// y/, / reverse keeps the separators in place.
+	check(sregx.Y{Patt: regexp.MustCompile(`, `), Cmd: sregx.Reverse{}}, []Test{
+		{"yreverse", "a, b, c", "c, b, a"},
+	}, t)
+}
+
+func TestReduce(t *testing.T) {
+	numbers := regexp.MustCompile(`[0-9.]+`)
+
+	tests := []struct {
+		name  string
+		cmd   sregx.Command
+		input string
+		want  string
+	}{
+		{"count", sregx.Count{}, "a 1 b 20 c 3", "a 3"},
+		{"sum", sregx.Sum{}, "a 1 b 20 c 3.5", "a 24.5"},
+		{"avg", sregx.Avg{}, "1 2 3 6", "3"},
+		{"min", sregx.Min{}, "07 3 10", "3"},
+		{"max", sregx.Max{}, "07 3 10", "10"},
+		{"none", sregx.Count{}, "none", "none"},
+	}
+
+	for _, tt := range tests {
+		check(sregx.X{Patt: numbers, Cmd: tt.cmd}, []Test{{tt.name, tt.input, tt.want}}, t)
+	}
+
+	lines := regexp.MustCompile(`.*\n`)
+	check(sregx.X{Patt: lines, Cmd: sregx.Max{Key: regexp.MustCompile(` ([0-9]+)`)}}, []Test{
+		{"maxkey", "a 5\nb 12\nc 9\n", "b 12\n"},
+	}, t)
+	check(sregx.X{Patt: lines, Cmd: sregx.Longest{}}, []Test{
+		{"longest", "ab\nabcd\nabc\n", "abcd\n"},
+	}, t)
+	check(sregx.X{Patt: lines, Cmd: sregx.Shortest{}}, []Test{
+		{"shortest", "ab\nabcd\nabc\n", "ab\n"},
+	}, t)
+}
+
+func TestArith(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmd   sregx.Arith
+		input string
+		want  string
+	}{
+		{"add", sregx.Arith{Op: '+', Operand: 1}, "41", "42"},
+		{"zeropad", sregx.Arith{Op: '+', Operand: 1}, "0099", "0100"},
+		{"spacepad", sregx.Arith{Op: '-', Operand: 1}, "  10\n", "   9\n"},
+		{"hex", sregx.Arith{Op: '+', Operand: 1}, "0x00FF", "0x0100"},
+		{"neg", sregx.Arith{Op: '-', Operand: 10}, "3", "-7"},
+		{"float", sregx.Arith{Op: '*', Operand: 2}, "1.50", "3.00"},
+		{"fraction", sregx.Arith{Op: '*', Operand: 1.5}, "3", "4.5"},
+		{"max", sregx.Arith{Op: '+', Operand: 1}, "9223372036854775807", "9223372036854775808"},
+		{"min", sregx.Arith{Op: '-', Operand: 1}, "-9223372036854775808", "-9223372036854775809"},
+		{"mul", sregx.Arith{Op: '*', Operand: -2}, "-9223372036854775808", "18446744073709551616"},
+		{"hexmax", sregx.Arith{Op: '+', Operand: 1}, "0x7fffffffffffffff", "0x8000000000000000"},
+		{"big", sregx.Arith{Op: '+', Operand: 1}, "+99999999999999999999", "+100000000000000000000"},
+	}
+
+	for _, tt := range tests {
+		check(tt.cmd, []Test{{tt.name, tt.input, tt.want}}, t)
+	}
+
+	var errs []error
+	cmd := sregx.Arith{
+		Op:      '+',
+		Operand: 1,
+		Err: func(err error) {
+			errs = append(errs, err)
+		},
+	}
+	check(cmd, []Test{{"nan", "abc", "abc"}}, t)
+	if len(errs) != 1 || !errors.Is(errs[0], sregx.ErrNotNumber) {
+		t.Errorf("got errors %v, want ErrNotNumber", errs)
+	}
+}
+
+func TestNumGuard(t *testing.T) {
+	over := func(f float64) bool { return f > 100 }
+	cmd := sregx.X{
+		Patt: regexp.MustCompile(`(?m)^.*$`),
+		Cmd: sregx.CommandPipeline{
+			sregx.GNum{
+				Cond: over,
+				Key:  regexp.MustCompile(`^\S+ (\S+)`),
+				Cmd:  sregx.A{Text: []byte(" big")},
+			},
+			sregx.VNum{
+				Cond: over,
+				Cmd:  sregx.I{Text: []byte("> ")},
+			},
+		},
+	}
+
+	check(cmd, []Test{
+		{"key", "a 150\nb 20\nc x", "> a 150 big\n> b 20\n> c x"},
+		{"whole", "200", "200"},
+	}, t)
+}
+
+func TestDict(t *testing.T) {
+	keys := [][]byte{[]byte("foo"), []byte("foobar"), []byte("bar"), []byte("straße")}
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3"), []byte("4")}
+
+	check(sregx.M{Dict: sregx.NewDict(keys, values, false, false)}, []Test{
+		{"longest", "foobar foo barfoo", "2 1 31"},
+		{"unicode", "STRASSE straße", "STRASSE 4"},
+	}, t)
+	check(sregx.M{Dict: sregx.NewDict(keys, values, true, true)}, []Test{
+		{"fold", "FOO Bar STRASSE", "1 3 STRASSE"},
+		{"foldunicode", "STRAßE", "4"},
+		{"word", "foo_bar foo-bar", "foo_bar 1-3"},
+	}, t)
+	check(sregx.X{
+		Patt: regexp.MustCompile(`\w+`),
+		Cmd:  sregx.M{Dict: sregx.NewDict(keys, values, false, false), Whole: true},
+	}, []Test{
+		{"whole", "foo foobar barfoo foob", "1 2 barfoo foob"},
+	}, t)
+
+	// A partial match of a long key must not hide a later occurrence once a
+	// shorter key is chosen.
+	nested := sregx.NewDict([][]byte{[]byte("abcdef"), []byte("abc"), []byte("de"), []byte("bcdx")}, nil, false, false)
+	check(sregx.X{Patt: nested, Cmd: sregx.C{Change: []byte("X")}}, []Test{
+		{"nested", "abcdeg abcdef abcdx", "XXg X Xdx"},
+	}, t)
+	if !nested.Match([]byte("xxabc")) || nested.Match([]byte("abdc")) {
+		t.Error("Match")
+	}
+
+	dict, err := sregx.ReadDict(strings.NewReader("a\tb\r\n\nc\td\te\n"), '\t', false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(sregx.M{Dict: dict}, []Test{{"tsv", "a c", "b d"}}, t)
+
+	dict, err = sregx.ReadDict(strings.NewReader("\"a,b\",c\n"), ',', false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(sregx.M{Dict: dict}, []Test{{"csv", "a,b", "c"}}, t)
+
+	if _, err := sregx.ReadDict(strings.NewReader("a\n"), '\t', false, false); err == nil {
+		t.Error("expected an error for a line without a value")
+	}
+}
+
+func TestWords(t *testing.T) {
+	words, err := sregx.ReadWords(strings.NewReader("gets\nstrcpy\r\n\nstrcpyn\n"), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(sregx.X{
+		Patt: words,
+		Cmd:  sregx.C{Change: []byte("X")},
+	}, []Test{
+		{"x", "strcpyn(strcpy(gets()))", "X(X(X()))"},
+	}, t)
+	check(sregx.Y{
+		Patt: words,
+		Cmd:  sregx.D{},
+	}, []Test{
+		{"y", "a gets b strcpy", "getsstrcpy"},
+	}, t)
+	check(sregx.G{
+		Patt: words,
+		Cmd:  sregx.C{Change: []byte("banned")},
+	}, []Test{
+		{"g", "call gets", "banned"},
+		{"nomatch", "call puts", "call puts"},
+	}, t)
+}
+
+func TestFuzzy(t *testing.T) {
+	cmd := sregx.X{
+		Patt: sregx.NewFuzzy([]byte("receive"), 2),
+		Cmd:  sregx.C{Change: []byte("receive")},
+	}
+
+	check(cmd, []Test{
+		{"exact", "we receive it", "we receive it"},
+		{"sub", "we recieve it", "we receive it"},
+		{"del", "we recive it", "we receive it"},
+		{"ins", "we receeive it", "we receive it"},
+		{"many", "receve, reseive", "receive, receive"},
+		{"far", "we reply", "we reply"},
+		{"unicode", "récéive", "receive"},
+	}, t)
+
+	g := sregx.G{
+		Patt: sregx.NewFuzzy([]byte("color"), 1),
+		Cmd:  sregx.C{Change: []byte("yes")},
+	}
+	check(g, []Test{
+		{"g", "the colour", "yes"},
+		{"nog", "the flavour", "the flavour"},
+	}, t)
+}
+
+func TestMatchCase(t *testing.T) {
+	tests := []struct {
+		match, repl, want string
+	}{
+		{"foo", "Bar", "bar"},
+		{"Foo", "bar", "Bar"},
+		{"FOO", "bar", "BAR"},
+		{"fOo", "bar", "bAr"},
+		{"fOo", "quux", "quux"},
+		{"F", "bar", "Bar"},
+		{"123", "Bar", "Bar"},
+		{"émile", "Élan", "élan"},
+	}
+
+	for _, tt := range tests {
+		if got := sregx.MatchCase([]byte(tt.match), []byte(tt.repl)); string(got) != tt.want {
+			t.Errorf("MatchCase(%q, %q) = %q, want %q", tt.match, tt.repl, got, tt.want)
+		}
+	}
+
+	cmd := sregx.S{
+		Patt:         regexp.MustCompile(`(?i)foo(\w*)`),
+		Replace:      []byte("bar$1"),
+		PreserveCase: true,
+	}
+	check(cmd, []Test{
+		{"s", "foo Foox FOOX", "bar Barx BARX"},
+	}, t)
+}
+
+func TestRecase(t *testing.T) {
+	tests := []struct {
+		style sregx.Style
+		input string
+		want  string
+	}{
+		{sregx.SnakeCase, "HTTPServer", "http_server"},
+		{sregx.SnakeCase, "parseURLQuery", "parse_url_query"},
+		{sregx.CamelCase, "http_server", "httpServer"},
+		{sregx.PascalCase, "http-server", "HttpServer"},
+		{sregx.KebabCase, "base64Encode", "base64-encode"},
+		{sregx.ScreamingSnakeCase, "maxValue", "MAX_VALUE"},
+		{sregx.CamelCase, "_private_name ", "_privateName "},
+		{sregx.SnakeCase, "__", "__"},
+	}
+
+	for _, tt := range tests {
+		check(sregx.Recase{Style: tt.style}, []Test{{tt.input, tt.input, tt.want}}, t)
+	}
+}
+
+func TestCaseModifiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace string
+		input   string
+		want    string
+	}{
+		{"u", `$1\u$2`, "foo_bar", "fooBar"},
+		{"U", `\U$1\E_$2`, "foo_bar", "FOO_bar"},
+		{"L", `\L$1$2`, "FOO_BAR", "foobar"},
+		{"uL", `\u\L$1 $2`, "fOO_bAR", "Foo bar"},
+		{"empty", `\u${3}$1`, "foo_bar", "Foo"},
+		{"literal", `$1\n$2`, "foo_bar", `foo\nbar`},
+		{"backslash", `\\U$1\\\u$2`, "foo_bar", `\Ufoo\Bar`},
+	}
+
+	for _, tt := range tests {
+		cmd := sregx.S{
+			Patt:    regexp.MustCompile(`(\w+)_(\w+)`),
+			Replace: []byte(tt.replace),
+		}
+		check(cmd, []Test{{tt.name, tt.input, tt.want}}, t)
+	}
+}
+
+func TestSubstSelect(t *testing.T) {
+	tests := []struct {
+		name string
+		sel  []sregx.Range
+		want string
+	}{
+		{"second", []sregx.Range{{Start: 1, End: 2}}, "a b a a"},
+		{"onward", []sregx.Range{{Start: 2, End: -1}}, "a a b b"},
+		{"first", []sregx.Range{{Start: 0, End: 2}}, "b b a a"},
+	}
+
+	for _, tt := range tests {
+		cmd := sregx.S{
+			Patt:    regexp.MustCompile(`a`),
+			Replace: []byte("b"),
+			Select:  tt.sel,
+		}
+		check(cmd, []Test{{tt.name, "a a a a", tt.want}}, t)
+	}
+
+	var errs []error
+	cmd := sregx.S{
+		Patt:    regexp.MustCompile(`a`),
+		Replace: []byte("b"),
+		Select:  []sregx.Range{{Start: 4, End: 5}},
+		Err: func(err error) {
+			errs = append(errs, err)
+		},
+	}
+	check(cmd, []Test{{"none", "a a a a", "a a a a"}}, t)
+	if len(errs) != 1 || !errors.Is(errs[0], sregx.ErrNoMatch) {
+		t.Errorf("got errors %v, want ErrNoMatch", errs)
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	x := sregx.X{
+		Patt: sregx.NewLiteral([]byte("a.b(c)")),
+		Cmd:  sregx.C{Change: []byte("_")},
+	}
+	check(x, []Test{
+		{"meta", "a.b(c) axb(c)", "_ axb(c)"},
+		{"many", "a.b(c)a.b(c)", "__"},
+		{"none", "abc", "abc"},
+	}, t)
+
+	empty := sregx.X{
+		Patt: sregx.NewLiteral(nil),
+		Cmd:  sregx.C{Change: []byte("-")},
+	}
+	check(empty, []Test{{"empty", "aé", "-a-é-"}}, t)
+
+	s := sregx.S{
+		Patt:    sregx.NewLiteral([]byte("$1")),
+		Replace: []byte("${2}"),
+	}
+	check(s, []Test{{"s", "$1 and $1", "${2} and ${2}"}}, t)
+}
+
+func TestAddress(t *testing.T) {
+	text := []byte("one\ntwo\nthree\n")
+	whole := sregx.Span{Start: 0, End: len(text)}
+	tests := []struct {
+		name string
+		addr sregx.Address
+		want string
+	}{
+		{"line", sregx.LineAddr(2), "two\n"},
+		{"zero", sregx.LineAddr(0), ""},
+		{"end", sregx.EndAddr{}, ""},
+		{"char", sregx.CompoundAddr{Left: sregx.CharAddr(1), Right: sregx.CharAddr(3), Op: ','}, "ne"},
+		{"search", sregx.SearchAddr{Patt: regexp.MustCompile(`t\w+`)}, "two"},
+		{"reverse", sregx.SearchAddr{Patt: regexp.MustCompile(`t\w+`), Reverse: true}, "three"},
+		{"lines", sregx.CompoundAddr{Left: sregx.LineAddr(2), Op: ','}, "two\nthree\n"},
+		{"plus", sregx.CompoundAddr{Left: sregx.LineAddr(1), Right: sregx.LineAddr(2), Op: '+'}, "three\n"},
+		{"minus", sregx.CompoundAddr{Left: sregx.EndAddr{}, Op: '-'}, "three\n"},
+		{"semi", sregx.CompoundAddr{
+			Left:  sregx.SearchAddr{Patt: regexp.MustCompile(`two`)},
+			Right: sregx.SearchAddr{Patt: regexp.MustCompile(`e`)},
+			Op:    ';',
+		}, "two\nthre"},
+	}
+
+	for _, tt := range tests {
+		s, err := tt.addr.Resolve(text, whole, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got := string(text[s.Start:s.End]); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := sregx.LineAddr(5).Resolve(text, whole, 0); !errors.Is(err, sregx.ErrRange) {
+		t.Errorf("got %v, want ErrRange", err)
+	}
+
+	at := sregx.At{
+		Addr: sregx.CompoundAddr{Left: sregx.LineAddr(2), Right: sregx.LineAddr(3), Op: ','},
+		Cmd:  sregx.D{},
+	}
+	check(at, []Test{{"at", string(text), "one\n"}}, t)
+
+	var buf bytes.Buffer
+	eq := sregx.Eq{
+		Addr: sregx.LineAddr(2),
+		W:    &buf,
+	}
+	eq.Evaluate(text)
+	if buf.String() != "2; #4,#8\n" {
+		t.Errorf("got %q, want %q", buf.String(), "2; #4,#8\n")
+	}
+}
+
+func TestBacktrack(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+		want  string
+	}{
+		{`\b(\w+) \1\b`, "the the cat sat sat", "X cat X"},
+		{`(?i)(a)\1`, "aA ab", "X ab"},
+		{`foo(?=bar)`, "foobar foobaz", "Xbar foobaz"},
+		{`foo(?!bar)`, "foobar foobaz", "foobar Xbaz"},
+		{`(?<=\$)\d+`, "$12 and 34", "$X and 34"},
+		{`(?<!\$)\b\d+`, "$12 and 34", "$12 and X"},
+		{`(?>a+)b`, "aab", "X"},
+		{`(?>a+)a`, "aaa", "aaa"},
+		{`a++a`, "aaa", "aaa"},
+		{`a{2,3}+`, "aaaa", "Xa"},
+		{`(?<d>\d)\k<d>`, "11 12", "X 12"},
+		{`x*`, "axxb", "XaXbX"},
+		{`[^a-c[:digit:]]+`, "ab1xyz", "ab1X"},
+	}
+
+	for _, tt := range tests {
+		bt, err := sregx.CompileBacktrack(tt.expr)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+		check(sregx.S{Patt: bt, Replace: []byte("X")}, []Test{{tt.expr, tt.input, tt.want}}, t)
+	}
+
+	bt, err := sregx.CompileBacktrack(`(?P<year>\d{4})-(\d\d)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(sregx.S{Patt: bt, Replace: []byte(`$2/${year} \U$1 $$`)}, []Test{
+		{"expand", "on 2021-06", "on 06/2021 2021 $"},
+	}, t)
+
+	for _, expr := range []string{`\1(a)(`, `(a)\2`, `\k<x>`, `a**`, `[b-a]`, `(?<=a+)b`, `(?<!(a)\1)b`} {
+		if _, err := sregx.CompileBacktrack(expr); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+
+	var got error
+	behind, err := sregx.CompileBacktrack(`(?<=a|cd)b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	behind.Err = func(err error) {
+		got = err
+	}
+	big := append(bytes.Repeat([]byte("xb"), 1<<20), "cdb"...)
+	if loc := behind.FindAllIndex(big, -1); len(loc) != 1 || loc[0][0] != len(big)-1 {
+		t.Errorf("lookbehind on large input: got %v", loc)
+	}
+	if got != nil {
+		t.Errorf("lookbehind on large input: %v", got)
+	}
+
+	slow, err := sregx.CompileBacktrack(`(a*)*b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow.MaxSteps = 10000
+	slow.Err = func(err error) {
+		got = err
+	}
+	if slow.Match([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaac")) {
+		t.Error("unexpected match")
+	}
+	if !errors.Is(got, sregx.ErrBacktrackLimit) {
+		t.Errorf("got %v, want ErrBacktrackLimit", got)
+	}
+}
+
+func TestLineBlocks(t *testing.T) {
+	text := "a\nBEGIN\nx\nEND\nb\nBEGIN\ny\n"
+	tests := []struct {
+		name string
+		l    sregx.L
+		want string
+	}{
+		{"patterns", sregx.L{
+			StartPatt: regexp.MustCompile(`^BEGIN$`),
+			EndPatt:   regexp.MustCompile(`^END$`),
+		}, "a\n[BEGIN\nx\nEND\n]b\n[BEGIN\ny\n]"},
+		{"same line", sregx.L{
+			StartPatt: regexp.MustCompile(`N`),
+			EndPatt:   regexp.MustCompile(`N`),
+		}, "a\n[BEGIN\n]x\n[END\n]b\n[BEGIN\n]y\n"},
+		{"after", sregx.L{
+			StartPatt: regexp.MustCompile(`BEGIN`),
+			End:       1,
+		}, "a\n[BEGIN\nx\n]END\nb\n[BEGIN\ny\n]"},
+		{"before", sregx.L{
+			Start:   -2,
+			EndPatt: sregx.NewLiteral([]byte("x")),
+		}, "[a\nBEGIN\nx\n]END\nb\nBEGIN\ny\n"},
+		{"none", sregx.L{
+			StartPatt: regexp.MustCompile(`z`),
+			EndPatt:   regexp.MustCompile(`END`),
+		}, text},
+	}
+
+	for _, tt := range tests {
+		tt.l.Cmd = sregx.CommandPipeline{sregx.I{Text: []byte("[")}, sregx.A{Text: []byte("]")}}
+		check(tt.l, []Test{{tt.name, text, tt.want}}, t)
+	}
+}
+
+func TestRanges(t *testing.T) {
+	text := "a\nb\nc\nd\ne\n"
+	x := sregx.C{Change: []byte("X\n")}
+	tests := []struct {
+		name string
+		cmd  sregx.Command
+		want string
+	}{
+		{"step", sregx.L{Cmd: x, Ranges: []sregx.Range{{Start: 0, End: -1, Step: 2}}}, "X\nb\nX\nd\nX\n"},
+		{"list", sregx.L{Cmd: x, Ranges: []sregx.Range{{Start: 3, End: 4}, {Start: 0, End: 2}}}, "X\nc\nX\ne\n"},
+		{"negative", sregx.L{Cmd: x, Ranges: []sregx.Range{{Start: -3, End: -1, Step: 1}}}, "a\nb\nc\nX\n"},
+		{"overlap", sregx.L{Cmd: x, Ranges: []sregx.Range{{Start: 0, End: 2}, {Start: 1, End: 3}}}, "X\nd\ne\n"},
+		{"count", sregx.L{Cmd: sregx.Count{}, Ranges: []sregx.Range{{Start: 1, End: 5, Step: 2}}}, "a\n2e\n"},
+		{"bytes", sregx.N{Cmd: sregx.C{Change: []byte("_")}, Ranges: []sregx.Range{{Start: 0, End: 4, Step: 2}, {Start: -2, End: -1}}}, "_\n_\nc\nd\ne_"},
+		{"empty", sregx.L{Cmd: x, Ranges: []sregx.Range{{Start: 4, End: 1}}}, text},
+	}
+
+	for _, tt := range tests {
+		check(tt.cmd, []Test{{tt.name, text, tt.want}}, t)
+	}
+}
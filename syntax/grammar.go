@@ -1,9 +1,17 @@
 package syntax
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	"github.com/zyedidia/gpeg/capture"
 	"github.com/zyedidia/gpeg/charset"
@@ -44,6 +52,39 @@ const (
 	nId
 	lId
 	uId
+	switchId
+	caseId
+	defaultId
+	pipeId
+	loopId
+	aId
+	iId
+	sortId
+	uniqId
+	reverseId
+	shuffleId
+	flagsId
+	countId
+	sumId
+	avgId
+	minId
+	maxId
+	longestId
+	shortestId
+	arithId
+	floatId
+	condId
+	opId
+	mId
+	wordsId
+	fuzzyId
+	keepCaseId
+	recaseId
+	delimId
+	pflagsId
+	quoteId
+	prangeId
+	rangesId
 )
 
 var grammar = p.Grammar("Sregex", map[string]p.Pattern{
@@ -60,42 +101,148 @@ var grammar = p.Grammar("Sregex", map[string]p.Pattern{
 		p.Literal("|"),
 		p.NonTerm("S"),
 	),
+	"Pipeline": p.CapId(p.Concat(
+		p.NonTerm("Command"),
+		p.Star(p.Concat(
+			p.NonTerm("Pipe"),
+			p.NonTerm("Command"),
+		)),
+	), pipeId),
 	"Command": p.CapId(p.Or(
+		p.Concat(
+			p.CapId(p.Literal("sort"), sortId),
+			p.Optional(p.NonTerm("Flags")),
+			p.Optional(p.NonTerm("Key")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("uniq"), uniqId),
+			p.Optional(p.NonTerm("Flags")),
+			p.Optional(p.NonTerm("Key")),
+		),
+		p.CapId(p.Literal("reverse"), reverseId),
+		p.Concat(
+			p.CapId(p.Literal("shuffle"), shuffleId),
+			p.Optional(p.NonTerm("Count")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("switch"), switchId),
+			p.NonTerm("S"),
+			p.NonTerm("Switch"),
+		),
+		p.Concat(
+			p.CapId(p.Literal("count"), countId),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("sum"), sumId),
+			p.Optional(p.NonTerm("Key")),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("avg"), avgId),
+			p.Optional(p.NonTerm("Key")),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("min"), minId),
+			p.Optional(p.NonTerm("Key")),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("max"), maxId),
+			p.Optional(p.NonTerm("Key")),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("longest"), longestId),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("shortest"), shortestId),
+			p.Optional(p.NonTerm("Then")),
+		),
+		p.Concat(
+			p.CapId(p.Literal("case"), recaseId),
+			p.NonTerm("Pattern"),
+		),
+		p.Concat(
+			p.CapId(p.Literal("loop"), loopId),
+			p.Optional(p.NonTerm("Count")),
+			p.NonTerm("S"),
+			p.NonTerm("Block"),
+		),
 		p.Concat(
 			p.CapId(p.Literal("x"), xId),
-			p.NonTerm("RCommand"),
+			p.NonTerm("SCommand"),
 		),
 		p.Concat(
 			p.CapId(p.Literal("y"), yId),
-			p.NonTerm("RCommand"),
+			p.NonTerm("SCommand"),
 		),
 		p.Concat(
 			p.CapId(p.Literal("g"), gId),
-			p.NonTerm("RCommand"),
+			p.Or(
+				p.NonTerm("NCommand"),
+				p.NonTerm("RCommand"),
+			),
 		),
 		p.Concat(
 			p.CapId(p.Literal("v"), vId),
-			p.NonTerm("RCommand"),
+			p.Or(
+				p.NonTerm("NCommand"),
+				p.NonTerm("RCommand"),
+			),
 		),
 		p.Concat(
 			p.CapId(p.Literal("s"), sId),
-			p.NonTerm("Pattern"),
-			p.NonTerm("RPattern"),
+			p.NonTerm("SPattern"),
+			p.NonTerm("SFlags"),
+		),
+		p.Concat(
+			p.CapId(p.Literal("S"), keepCaseId),
+			// S/x/ is left to a user command named S, which predates this.
+			p.And(p.Concat(
+				enclosed(2),
+				p.Star(p.Set(sflagChars)),
+				p.NonTerm("End"),
+			)),
+			p.NonTerm("SPattern"),
+			p.NonTerm("SFlags"),
 		),
 		p.Concat(
 			p.CapId(p.Literal("c"), cId),
 			p.NonTerm("Pattern"),
 		),
+		p.Concat(
+			p.CapId(p.Literal("a"), aId),
+			p.NonTerm("Pattern"),
+		),
+		p.Concat(
+			p.CapId(p.Literal("i"), iId),
+			p.NonTerm("Pattern"),
+		),
+		p.Concat(
+			p.CapId(p.Literal("m"), mId),
+			p.Optional(p.NonTerm("Flags")),
+			p.NonTerm("Pattern"),
+		),
 		p.Concat(
 			p.CapId(p.Literal("n"), nId),
-			p.NonTerm("Range"),
+			p.NonTerm("Ranges"),
 			p.NonTerm("Command"),
 		),
 		p.Concat(
 			p.CapId(p.Literal("l"), lId),
-			p.NonTerm("Range"),
+			p.Or(
+				p.NonTerm("Ranges"),
+				p.NonTerm("PRange"),
+			),
 			p.NonTerm("Command"),
 		),
+		p.Concat(
+			p.CapId(p.Set(charset.New([]byte{'+', '-', '*'})), arithId),
+			p.NonTerm("Float"),
+		),
 		p.CapId(p.Literal("p"), pId),
 		p.CapId(p.Literal("d"), dId),
 		p.Concat(
@@ -112,30 +259,169 @@ var grammar = p.Grammar("Sregex", map[string]p.Pattern{
 			p.NonTerm("Pattern"),
 		),
 	), cmdId),
+	"Switch": p.Concat(
+		p.Or(
+			p.Literal("{"),
+			p.Error("No opening '{' found", nil),
+		),
+		p.NonTerm("S"),
+		p.NonTerm("Case"),
+		p.Star(p.Concat(
+			p.NonTerm("S"),
+			p.Literal(";"),
+			p.NonTerm("S"),
+			p.NonTerm("Case"),
+		)),
+		p.NonTerm("S"),
+		p.Or(
+			p.Literal("}"),
+			p.Error("No closing '}' found", nil),
+		),
+	),
+	"Block": p.Concat(
+		p.Or(
+			p.Literal("{"),
+			p.Error("No opening '{' found", nil),
+		),
+		p.NonTerm("S"),
+		p.NonTerm("Pipeline"),
+		p.NonTerm("S"),
+		p.Or(
+			p.Literal("}"),
+			p.Error("No closing '}' found", nil),
+		),
+	),
+	"Case": p.Or(
+		p.CapId(p.Concat(
+			p.Literal("default"),
+			p.NonTerm("S"),
+			p.NonTerm("Pipeline"),
+		), defaultId),
+		p.CapId(p.Concat(
+			p.Or(
+				p.NonTerm("Words"),
+				p.NonTerm("Fuzzy"),
+				p.NonTerm("Regex"),
+			),
+			p.NonTerm("S"),
+			p.NonTerm("Pipeline"),
+		), caseId),
+	),
+	"SCommand": p.Concat(
+		p.Or(
+			p.NonTerm("Words"),
+			p.NonTerm("Fuzzy"),
+			p.NonTerm("Regex"),
+		),
+		p.Optional(p.Concat(
+			p.NonTerm("S"),
+			p.And(p.Literal("[")),
+			p.NonTerm("Range"),
+		)),
+		p.NonTerm("S"),
+		p.NonTerm("Command"),
+	),
+	"NCommand": p.Concat(
+		p.And(p.Literal("[")),
+		p.NonTerm("Cond"),
+		p.Optional(p.NonTerm("Key")),
+		p.NonTerm("S"),
+		p.NonTerm("Command"),
+	),
+	"Cond": p.Concat(
+		p.Literal("["),
+		p.NonTerm("S"),
+		p.CapId(p.Or(
+			p.Concat(
+				p.CapId(p.Or(
+					p.Literal(">="),
+					p.Literal("<="),
+					p.Literal("=="),
+					p.Literal("!="),
+					p.Literal(">"),
+					p.Literal("<"),
+				), opId),
+				p.NonTerm("S"),
+				p.NonTerm("Float"),
+			),
+			p.Concat(
+				p.NonTerm("Float"),
+				p.NonTerm("S"),
+				p.Or(
+					p.Literal(".."),
+					p.Error("Expected '..'", nil),
+				),
+				p.NonTerm("S"),
+				p.NonTerm("Float"),
+			),
+		), condId),
+		p.NonTerm("S"),
+		p.Or(
+			p.Literal("]"),
+			p.Error("No closing ']' found", nil),
+		),
+	),
 	"RCommand": p.Concat(
-		p.NonTerm("Pattern"),
+		p.Or(
+			p.NonTerm("Fuzzy"),
+			p.NonTerm("Regex"),
+		),
 		p.NonTerm("S"),
 		p.NonTerm("Command"),
 	),
-	"Pattern": p.Concat(
+	"Pattern":  delimited(1, ""),
+	"Regex":    delimited(1, "PFlags"),
+	"KeyRegex": delimited(1, "KeyFlags"),
+	"SPattern": delimited(2, ""),
+	// Since p is also a command, flags are only read as such when a command
+	// follows them, so that x/foo/p still prints.
+	"PFlags": p.Concat(
+		p.CapId(p.Plus(p.Set(patternFlags)), pflagsId),
+		p.And(p.Concat(
+			p.Plus(p.NonTerm("Space")),
+			p.Set(commandStart.Add(charset.New([]byte{'['}))),
+		)),
+	),
+	// A key may also end the command, but a lone p there is still the
+	// command that follows the key, as in sum/\d+/p.
+	"KeyFlags": p.Concat(
+		p.Not(p.Concat(
+			p.Literal("p"),
+			p.NonTerm("End"),
+		)),
+		p.CapId(p.Plus(p.Set(patternFlags)), pflagsId),
+		p.And(p.Or(
+			p.Concat(
+				p.Plus(p.NonTerm("Space")),
+				p.Set(commandStart),
+			),
+			p.NonTerm("End"),
+		)),
+	),
+	"End": p.Concat(
+		p.NonTerm("S"),
 		p.Or(
-			p.Literal("/"),
-			p.Error("No starting '/' found", nil),
+			p.Not(p.Any(1)),
+			p.Set(charset.New([]byte("|};"))),
 		),
-		p.NonTerm("RPattern"),
 	),
-	"RPattern": p.Or(
+	"Fuzzy": p.CapId(p.Concat(
+		p.Literal("~"),
+		p.NonTerm("Number"),
+		p.NonTerm("Pattern"),
+	), fuzzyId),
+	"Words": p.Concat(
+		p.Literal("@"),
 		p.CapId(p.Concat(
 			p.Star(p.Concat(
-				p.Not(p.Literal("/")),
+				p.Not(p.Literal("@")),
 				p.NonTerm("Char"),
 			)),
 			p.Or(
-				p.Literal("/"),
-				p.Error("No closing '/' found", nil),
+				p.Literal("@"),
+				p.Error("No closing '@' found", nil),
 			),
-		), pattId),
-		p.Error("Pattern failed to match", nil),
+		), wordsId),
 	),
 	"Range": p.CapId(p.Concat(
 		p.Or(
@@ -148,19 +434,116 @@ var grammar = p.Grammar("Sregex", map[string]p.Pattern{
 			p.Error("No ':' found", nil),
 		),
 		p.NonTerm("Number"),
+		p.Optional(p.Concat(
+			p.Literal(":"),
+			p.NonTerm("Number"),
+		)),
+		p.Or(
+			p.Literal("]"),
+			p.Error("No closing ']' found", nil),
+		),
+	), rangeId),
+	"Ranges": p.CapId(p.Concat(
+		p.Or(
+			p.Literal("["),
+			p.Error("No opening '[' found", nil),
+		),
+		p.NonTerm("Slice"),
+		p.Star(p.Concat(
+			p.Literal(","),
+			p.NonTerm("Slice"),
+		)),
 		p.Or(
 			p.Literal("]"),
 			p.Error("No closing ']' found", nil),
 		),
+	), rangesId),
+	"Slice": p.CapId(p.Concat(
+		p.NonTerm("Number"),
+		p.Or(
+			p.Literal(":"),
+			p.Error("No ':' found", nil),
+		),
+		p.NonTerm("Number"),
+		p.Optional(p.Concat(
+			p.Literal(":"),
+			p.NonTerm("Number"),
+		)),
 	), rangeId),
+	"PRange": p.CapId(p.Concat(
+		p.Literal("["),
+		p.Or(
+			p.Concat(
+				p.NonTerm("Number"),
+				p.Literal(":"),
+				p.NonTerm("Bound"),
+			),
+			p.Concat(
+				p.NonTerm("Bound"),
+				p.Literal(":"),
+				p.Or(
+					p.NonTerm("Offset"),
+					p.NonTerm("Number"),
+					p.NonTerm("Bound"),
+				),
+			),
+		),
+		p.Or(
+			p.Literal("]"),
+			p.Error("No closing ']' found", nil),
+		),
+	), prangeId),
+	"Bound": p.Concat(
+		p.And(p.Set(delimiters.Add(charset.New([]byte{'\''})))),
+		p.NonTerm("Pattern"),
+	),
+	"Offset": p.CapId(p.Concat(
+		p.Literal("+"),
+		p.Plus(p.Set(charset.Range('0', '9'))),
+	), numId),
+	"Flags": p.Concat(
+		p.Literal("["),
+		p.CapId(p.Star(p.Set(charset.Range('a', 'z').Add(charset.Range('A', 'Z')))), flagsId),
+		p.Or(
+			p.Literal("]"),
+			p.Error("No closing ']' found", nil),
+		),
+	),
+	"SFlags": p.Concat(
+		p.Optional(p.Or(
+			p.Concat(
+				p.And(p.Literal("[")),
+				p.NonTerm("Range"),
+			),
+			p.CapId(p.Plus(p.Set(charset.Range('0', '9'))), numId),
+		)),
+		p.CapId(p.Star(p.Set(charset.Range('a', 'z').Add(charset.Range('A', 'Z')))), flagsId),
+	),
+	"Key": p.Concat(
+		p.And(p.Set(delimiters.Sub(charset.New([]byte{'|'})))),
+		p.NonTerm("KeyRegex"),
+	),
+	"Then": p.Concat(
+		p.NonTerm("S"),
+		p.And(p.Set(charset.Range('a', 'z').Add(charset.Range('A', 'Z')))),
+		p.NonTerm("Command"),
+	),
+	"Count": p.Concat(
+		p.Literal("["),
+		p.NonTerm("Number"),
+		p.Or(
+			p.Literal("]"),
+			p.Error("No closing ']' found", nil),
+		),
+	),
 	"Char": p.CapId(p.Or(
 		p.Concat(
 			p.Literal("\\"),
-			p.Set(charset.New([]byte{'/', 'n', 'r', 't', '\\'})),
+			p.Set(charset.New([]byte{'/', 'n', 'r', 't', 'a', 'e', '\\'})),
 		),
 		p.Concat(
 			p.Literal("\\"),
-			p.Set(charset.Range('0', '2')),
+			p.Set(charset.Range('0', '3')),
 			p.Set(charset.Range('0', '7')),
 			p.Set(charset.Range('0', '7')),
 		),
@@ -169,6 +552,44 @@ var grammar = p.Grammar("Sregex", map[string]p.Pattern{
 			p.Set(charset.Range('0', '7')),
 			p.Optional(p.Set(charset.Range('0', '7'))),
 		),
+		p.Concat(
+			p.Literal("\\x"),
+			p.Or(
+				p.Repeat(p.Set(hexDigits), 2),
+				p.Error("Expected two hex digits after \\x", nil),
+			),
+		),
+		p.Concat(
+			p.Literal("\\u{"),
+			p.And(p.Set(hexDigits)),
+			p.Star(p.Literal("0")),
+			p.Or(
+				p.Concat(
+					p.And(p.Concat(
+						p.Set(charset.New([]byte("dD"))),
+						p.Set(charset.New([]byte("89abcdefABCDEF"))),
+						p.Repeat(p.Set(hexDigits), 2),
+						p.Literal("}"),
+					)),
+					p.Error("Surrogate code points are not characters", nil),
+				),
+				p.Concat(p.Literal("10"), p.Repeat(p.Set(hexDigits), 4), p.Literal("}")),
+				p.Concat(
+					p.Set(hexDigits),
+					p.Optional(p.Set(hexDigits)),
+					p.Optional(p.Set(hexDigits)),
+					p.Optional(p.Set(hexDigits)),
+					p.Optional(p.Set(hexDigits)),
+					p.Literal("}"),
+				),
+				p.Literal("}"),
+				p.Error("Expected a code point of at most 10FFFF and '}' after \\u{", nil),
+			),
+		),
+		p.Concat(
+			p.Literal("\\"),
+			p.Set(keptEscapes),
+		),
 		p.Concat(
 			p.Not(p.Literal("\\")),
 			p.Or(
@@ -182,17 +603,163 @@ var grammar = p.Grammar("Sregex", map[string]p.Pattern{
 		p.Optional(p.Literal("-")),
 		p.Plus(p.Set(charset.Range('0', '9'))),
 	), numId),
+	"Float": p.Or(
+		p.CapId(p.Concat(
+			p.Optional(p.Literal("-")),
+			p.Plus(p.Set(charset.Range('0', '9'))),
+			p.Optional(p.Concat(
+				p.Literal("."),
+				p.Plus(p.Set(charset.Range('0', '9'))),
+			)),
+		), floatId),
+		p.Error("Expected number", nil),
+	),
 	"S":     p.Star(p.NonTerm("Space")),
 	"Space": p.Set(charset.New([]byte{9, 10, 11, 12, 13, ' '})),
 })
 
+// patternFlags are the flags that may follow a pattern (see regexFlags).
+var patternFlags = charset.New([]byte("ismxlpb"))
+
+// commandStart are the characters that may start a command.
+var commandStart = charset.Range('a', 'z').Add(charset.Range('A', 'Z')).Add(charset.New([]byte("+-*")))
+
+// delimiters are the characters that may enclose a pattern. Brackets are not
+// delimiters, and nor are @ and ~, which introduce other kinds of pattern. A
+// pattern may also be quoted with ', which makes it literal.
+var delimiters = charset.New([]byte("!\"#$%&*+,-./:;<=>?^_`|"))
+
+// delimited returns a pattern matching n pattern captures enclosed by the same
+// delimiter, which are separated and ended by that delimiter too. Within a
+// pattern, the delimiter may be escaped with a backslash. If flags is not
+// empty, the last pattern may be followed by regular expression flags, as
+// matched by the nonterminal it names.
+func delimited(n int, flags string) p.Pattern {
+	var alts []p.Pattern
+	for c := 0; c < 256; c++ {
+		if !delimiters.Has(byte(c)) && c != '\'' {
+			continue
+		}
+		d := string(rune(c))
+		end := p.Literal(d)
+		if c == '\'' {
+			end = p.CapId(end, quoteId)
+		}
+		seq := []p.Pattern{p.Literal(d)}
+		for i := 0; i < n; i++ {
+			body := []p.Pattern{
+				p.Star(p.Concat(
+					p.Not(p.Literal(d)),
+					p.Or(
+						p.CapId(p.Concat(p.Literal("\\"), p.Literal(d)), delimId),
+						p.NonTerm("Char"),
+					),
+				)),
+				p.Or(
+					end,
+					p.Error("No closing '"+d+"' found", nil),
+				),
+			}
+			if flags != "" && i == n-1 {
+				body = append(body, p.Optional(p.NonTerm(flags)))
+			}
+			seq = append(seq, p.CapId(p.Concat(body...), pattId))
+		}
+		alts = append(alts, p.Concat(seq...))
+	}
+	alts = append(alts, p.Error("No starting delimiter found", nil))
+	return p.Or(alts...)
+}
+
+// enclosed returns a pattern matching n patterns enclosed by the same
+// delimiter, as delimited does, but without captures or errors, for use in a
+// lookahead.
+func enclosed(n int) p.Pattern {
+	var alts []p.Pattern
+	for c := 0; c < 256; c++ {
+		if !delimiters.Has(byte(c)) && c != '\'' {
+			continue
+		}
+		d := p.Literal(string(rune(c)))
+		seq := []p.Pattern{d}
+		for i := 0; i < n; i++ {
+			seq = append(seq, p.Star(p.Concat(
+				p.Not(d),
+				p.Or(p.Concat(p.Literal("\\"), p.Any(1)), p.Any(1)),
+			)), d)
+		}
+		alts = append(alts, p.Concat(seq...))
+	}
+	return p.Or(alts...)
+}
+
+// sflagChars are the characters that may follow the replacement text of s
+// or S, as flags or a selection of occurrences.
+var sflagChars = charset.Range('a', 'z').Add(charset.Range('A', 'Z')).Add(charset.Range('0', '9')).Add(charset.New([]byte("[:-]")))
+
+// An Option configures compilation.
+type Option func(*compiler)
+
+// OnError sets the handler that compiled commands use to report errors that
+// occur during evaluation, such as a loop reaching its iteration limit. Without
+// it such errors are ignored, except that an s or S command with the e flag
+// writes its error to standard error.
+func OnError(h sregx.ErrorHandler) Option {
+	return func(cp *compiler) {
+		cp.errh = h
+	}
+}
+
+// printError is the error handler of an s command with the e flag when no
+// handler is given with OnError.
+func printError(err error) {
+	fmt.Fprintln(os.Stderr, err)
+}
+
+// FixedStrings treats every pattern as a literal string, as if it had the l
+// flag.
+func FixedStrings() Option {
+	return func(cp *compiler) {
+		cp.fixed = true
+	}
+}
+
+// Longest makes every regular expression prefer leftmost-longest matches, as
+// if it had the p flag.
+func Longest() Option {
+	return func(cp *compiler) {
+		cp.longest = true
+	}
+}
+
+// Plan9 selects the regular expression syntax of Plan 9, as used by sam and
+// acme, in place of the Go syntax. Regular expressions are translated to the
+// Go syntax, and ^ and $ match at line boundaries. In the replacement text of
+// s and S, & stands for the match and \1 through \9 for submatches.
+func Plan9() Option {
+	return func(cp *compiler) {
+		cp.plan9 = true
+	}
+}
+
+// code is the grammar encoded for the parsing machine. Encoding it takes much
+// longer than parsing a typical command, so it is done once, on first use.
+var (
+	codeOnce sync.Once
+	code     vm.VMCode
+)
+
 // Compile the input string s into an sregx expression. The out writer will be
 // used when creating p commands (a p command will write to the given writer,
 // generally this will be os.Stdout). A map of user functions may be given to
 // define custom command types. The command name must be a single letter.
-func Compile(s string, out io.Writer, usrfns map[string]EvalMaker) (sregx.Command, error) {
-	peg := p.MustCompile(grammar)
-	code := vm.Encode(peg)
+// User functions named a, i, m, or S take precedence over the built-in
+// commands of those names when written in the form x/def/. Options may be
+// given to further configure compilation.
+func Compile(s string, out io.Writer, usrfns map[string]EvalMaker, opts ...Option) (sregx.Command, error) {
+	codeOnce.Do(func() {
+		code = vm.Encode(p.MustCompile(grammar))
+	})
 	in := input.StringReader(s)
 	machine := vm.NewVM(in, code)
 	match, n, ast, errs := machine.Exec(memo.NoneTable{})
@@ -206,11 +773,19 @@ func Compile(s string, out io.Writer, usrfns map[string]EvalMaker) (sregx.Comman
 		}}
 	}
 
-	inp := input.NewInput(in)
+	cp := &compiler{
+		in:     input.NewInput(in),
+		out:    out,
+		usrfns: usrfns,
+	}
+	for _, opt := range opts {
+		opt(cp)
+	}
+
 	cmds := make(sregx.CommandPipeline, len(ast))
 	for i, n := range ast {
 		var err error
-		cmds[i], err = compile(n, inp, out, usrfns)
+		cmds[i], err = cp.compile(n)
 		if err != nil {
 			return nil, MultiError{err}
 		}
@@ -219,155 +794,1138 @@ func Compile(s string, out io.Writer, usrfns map[string]EvalMaker) (sregx.Comman
 	return cmds, nil
 }
 
+// keptEscapes are the characters that may follow a backslash to form an
+// escape of the regular expression syntax, such as \b or \., or a case
+// modifier of replacement text, such as \U, or a Plan 9 submatch reference
+// that is not octal, \8 or \9, or a named backreference, \k. These escapes
+// are kept as they are, so that the regular expression or substitution sees
+// the backslash.
+var keptEscapes = charset.New([]byte("89bBkwWdDsSAzpPQEULul!\"#$%&'()*+,-.:;<=>?@[]^_`{|}~"))
+
+var hexDigits = charset.Range('0', '9').Add(charset.Range('a', 'f')).Add(charset.Range('A', 'F'))
+
 var special = map[byte]byte{
 	'n':  '\n',
 	'r':  '\r',
 	't':  '\t',
+	'a':  '\a',
+	'e':  0x1b,
 	'\\': '\\',
 	'/':  '/',
 }
 
-func char(b []byte) byte {
-	switch b[0] {
-	case '\\':
-		for k, v := range special {
-			if b[1] == k {
-				return byte(v)
-			}
-		}
-
-		i, err := strconv.ParseInt(string(b[1:]), 8, 8)
-		if err != nil {
-			panic("bad char")
-		}
-		return byte(i)
-	default:
-		return byte(b[0])
+// char returns the character, or bytes, denoted by the character capture b.
+// The grammar only accepts valid escapes, so char does not fail: an octal
+// escape is at most \377, and a \u{...} escape is at most \u{10FFFF} and not
+// a surrogate.
+func char(b []byte) []byte {
+	if b[0] != '\\' {
+		return b[:1]
+	}
+	if c, ok := special[b[1]]; ok {
+		return []byte{c}
 	}
+	switch {
+	case len(b) > 2 && b[1] == 'x':
+		r, _ := strconv.ParseUint(string(b[2:]), 16, 8)
+		return []byte{byte(r)}
+	case len(b) > 2 && b[1] == 'u':
+		r, _ := strconv.ParseUint(string(b[3:len(b)-1]), 16, 32)
+		return []byte(string(rune(r)))
+	case keptEscapes.Has(b[1]):
+		return b
+	}
+	i, _ := strconv.ParseUint(string(b[1:]), 8, 8)
+	return []byte{byte(i)}
+}
+
+// numeric reports whether the character capture b is an escape that gives a
+// character by its code, such as \56 or \x2e.
+func numeric(b []byte) bool {
+	return b[0] == '\\' && (b[1] >= '0' && b[1] <= '7' || len(b) > 2 && (b[1] == 'x' || b[1] == 'u'))
 }
 
 func pattern(n *capture.Node, in *input.Input) string {
 	var bytes []byte
 	for _, c := range n.Children {
-		if c.Id != charId {
-			continue
+		switch c.Id {
+		case charId:
+			bytes = append(bytes, char(in.Slice(c.Start(), c.End()))...)
+		case delimId:
+			bytes = append(bytes, in.Slice(c.Start(), c.End())[1])
 		}
-
-		bytes = append(bytes, char(in.Slice(c.Start(), c.End())))
 	}
 	return string(bytes)
 }
 
-func rangeNums(n *capture.Node, in *input.Input) (int, int) {
-	startn := n.Children[0]
-	endn := n.Children[1]
-
-	start, _ := strconv.Atoi(string(in.Slice(startn.Start(), startn.End())))
-	end, _ := strconv.Atoi(string(in.Slice(endn.Start(), endn.End())))
-	return start, end
+// regexPattern is like pattern, but keeps the backslash of an escaped
+// delimiter, so that a delimiter that is also a metacharacter, such as | or .,
+// matches literally. Likewise a metacharacter given by its code, as in \x2e,
+// is escaped.
+func regexPattern(n *capture.Node, in *input.Input) string {
+	var bytes []byte
+	for _, c := range n.Children {
+		switch c.Id {
+		case charId:
+			bytes = append(bytes, regexChar(in.Slice(c.Start(), c.End()))...)
+		case delimId:
+			bytes = append(bytes, in.Slice(c.Start(), c.End())...)
+		}
+	}
+	return string(bytes)
 }
 
-// An EvalMaker uses some definition string to create a function that can do
-// evaluation.
-type EvalMaker func(s string) (sregx.Evaluator, error)
-
-func compile(n *capture.Node, in *input.Input, out io.Writer, usrfns map[string]EvalMaker) (sregx.Command, error) {
-	var c sregx.Command
-
-	id := n.Children[0].Id
-	switch id {
-	case xId, yId, gId, vId, sId:
-		regex, err := regexp.Compile(pattern(n.Children[1], in))
-		if err != nil {
-			return nil, &vm.ParseError{
-				Pos:     n.Children[1].Start(),
-				Message: err.Error(),
+// replacePattern is like pattern, but for replacement text that is expanded
+// by a sregx.S with a Submatcher: a backslash that is not part of a kept
+// escape, such as one given by \\, is escaped, so that it cannot begin a case
+// modifier.
+func replacePattern(n *capture.Node, in *input.Input) []byte {
+	var bytes []byte
+	for _, c := range n.Children {
+		switch c.Id {
+		case charId:
+			raw := in.Slice(c.Start(), c.End())
+			if raw[0] == '\\' && len(raw) == 2 && keptEscapes.Has(raw[1]) {
+				bytes = append(bytes, raw...)
+				continue
 			}
-		}
-		if id == sId {
-			c = sregx.S{
-				Patt:    regex,
-				Replace: []byte(pattern(n.Children[2], in)),
+			for _, b := range char(raw) {
+				if b == '\\' {
+					bytes = append(bytes, '\\')
+				}
+				bytes = append(bytes, b)
+			}
+		case delimId:
+			bytes = append(bytes, in.Slice(c.Start(), c.End())[1])
+		}
+	}
+	return bytes
+}
+
+// regexChar is like char, but escapes a metacharacter given by its code.
+func regexChar(b []byte) []byte {
+	c := char(b)
+	if numeric(b) {
+		return []byte(regexp.QuoteMeta(string(c)))
+	}
+	return c
+}
+
+// backtrackPattern is like regexPattern, but keeps escapes of digits other
+// than 0 as they are, since they are backreferences rather than octal escapes
+// for a Backtrack.
+func backtrackPattern(n *capture.Node, in *input.Input) string {
+	var bytes []byte
+	for _, c := range n.Children {
+		raw := in.Slice(c.Start(), c.End())
+		switch {
+		case c.Id == charId && raw[0] == '\\' && raw[1] >= '1' && raw[1] <= '9':
+			bytes = append(bytes, raw...)
+		case c.Id == charId:
+			bytes = append(bytes, regexChar(raw)...)
+		case c.Id == delimId:
+			bytes = append(bytes, raw...)
+		}
+	}
+	return string(bytes)
+}
+
+// extended returns the regular expression expr in extended syntax converted to
+// the standard syntax. In extended syntax, whitespace outside character classes
+// is ignored unless escaped with a backslash, and # starts a comment that runs
+// to the end of the line.
+func extended(expr string) string {
+	var b strings.Builder
+	class := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\' && i+1 < len(expr):
+			if !class && isSpace(expr[i+1]) {
+				b.WriteByte(expr[i+1])
+			} else {
+				b.WriteString(expr[i : i+2])
+			}
+			i++
+		case class:
+			class = c != ']'
+			b.WriteByte(c)
+		case c == '[':
+			class = true
+			b.WriteByte(c)
+			// A ] at the start of a class is literal.
+			if strings.HasPrefix(expr[i+1:], "^]") {
+				b.WriteString("^]")
+				i += 2
+			} else if strings.HasPrefix(expr[i+1:], "]") {
+				b.WriteByte(']')
+				i++
+			}
+		case c == '#':
+			for i+1 < len(expr) && expr[i+1] != '\n' {
+				i++
+			}
+		case isSpace(c):
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func number(n *capture.Node, in *input.Input) int {
+	num, _ := strconv.Atoi(string(in.Slice(n.Start(), n.End())))
+	return num
+}
+
+func rangeNums(n *capture.Node, in *input.Input) (int, int) {
+	return number(n.Children[0], in), number(n.Children[1], in)
+}
+
+// An EvalMaker uses some definition string to create a function that can do
+// evaluation.
+type EvalMaker func(s string) (sregx.Evaluator, error)
+
+// styles maps the names accepted by the case command to identifier styles.
+var styles = map[string]sregx.Style{
+	"snake":     sregx.SnakeCase,
+	"camel":     sregx.CamelCase,
+	"pascal":    sregx.PascalCase,
+	"kebab":     sregx.KebabCase,
+	"screaming": sregx.ScreamingSnakeCase,
+}
+
+// defaultLoopMax is the iteration limit of a loop command that does not
+// specify one.
+const defaultLoopMax = 1000
+
+// A compiler holds the state used while compiling a parsed expression.
+type compiler struct {
+	in      *input.Input
+	out     io.Writer
+	usrfns  map[string]EvalMaker
+	errh    sregx.ErrorHandler
+	fixed   bool
+	longest bool
+	plan9   bool
+
+	// counter is the match counter of the innermost enclosing x command, and
+	// counted records whether any text has referred to it.
+	counter *sregx.Counter
+	counted bool
+
+	// selected records whether the command being compiled operates on the
+	// selections of an x or y command rather than on the whole input.
+	selected bool
+
+	// pieces records whether the command being compiled is itself the command
+	// of an x or y, or of an n or l that selects pieces, and so may be a
+	// collective or a reducer.
+	pieces bool
+
+	// last is the most recently compiled pattern, which an empty pattern
+	// stands for.
+	last sregx.Matcher
+}
+
+// regex compiles the regular expression in the pattern capture n.
+func (cp *compiler) regex(n *capture.Node) (*regexp.Regexp, error) {
+	return cp.regexFlags(n, "")
+}
+
+// patternFlags returns flags along with those that follow the pattern capture
+// n. A quoted pattern, or any pattern if compiling with FixedStrings, has the
+// flag l, and any pattern has the flag p if compiling with Longest.
+func (cp *compiler) patternFlags(n *capture.Node, flags string) string {
+	for _, c := range n.Children {
+		switch c.Id {
+		case pflagsId:
+			flags += string(cp.in.Slice(c.Start(), c.End()))
+		case quoteId:
+			flags += "l"
+		}
+	}
+	if cp.fixed {
+		flags += "l"
+	}
+	if cp.longest {
+		flags += "p"
+	}
+	return flags
+}
+
+// regexFlags compiles the pattern capture n as a regular expression with the
+// given flags, along with any that follow the pattern, set. The flags i, s,
+// and m are those of the syntax (?flags). The flag x selects the extended
+// syntax, in which whitespace and comments are ignored, the flag l treats the
+// pattern as a literal string, and the flag p selects leftmost-longest (POSIX)
+// rather than leftmost-first matching. The flag b is only accepted by literal.
+// The empty pattern stands for the previous one (see previous).
+func (cp *compiler) regexFlags(n *capture.Node, flags string) (*regexp.Regexp, error) {
+	if empty(n) {
+		last, err := cp.previous(n, flags)
+		if err != nil {
+			return nil, err
+		}
+		regex, ok := last.(*regexp.Regexp)
+		if !ok {
+			return nil, &vm.ParseError{
+				Pos:     n.Start(),
+				Message: "the previous pattern is not a regular expression",
+			}
+		}
+		return regex, nil
+	}
+
+	expr, flags, err := cp.regexExpr(n, flags)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(flags, "b") {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: "the b flag is not supported for this pattern",
+		}
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: err.Error(),
+		}
+	}
+	if strings.Contains(flags, "p") {
+		regex.Longest()
+	}
+	cp.last = regex
+	return regex, nil
+}
+
+// empty reports whether the pattern capture n holds the empty pattern.
+func empty(n *capture.Node) bool {
+	for _, c := range n.Children {
+		if c.Id == charId || c.Id == delimId {
+			return false
+		}
+	}
+	return true
+}
+
+// previous returns the pattern compiled most recently before the empty pattern
+// capture n, which it stands for, as in sed and sam. Since the previous pattern
+// is reused as it was compiled, n may not have flags of its own.
+func (cp *compiler) previous(n *capture.Node, flags string) (sregx.Matcher, error) {
+	for _, c := range n.Children {
+		if c.Id == pflagsId {
+			flags += string(cp.in.Slice(c.Start(), c.End()))
+		}
+	}
+	if flags != "" {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: "an empty pattern cannot have flags",
+		}
+	}
+	if cp.last == nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: "no previous pattern",
+		}
+	}
+	return cp.last, nil
+}
+
+// regexExpr returns the regular expression in the pattern capture n, rewritten
+// as regexFlags describes, and all of its flags.
+func (cp *compiler) regexExpr(n *capture.Node, flags string) (string, string, error) {
+	flags = cp.patternFlags(n, flags)
+	expr := regexPattern(n, cp.in)
+	if strings.Contains(flags, "b") {
+		expr = backtrackPattern(n, cp.in)
+	}
+	if strings.Contains(flags, "l") {
+		expr = regexp.QuoteMeta(pattern(n, cp.in))
+	} else {
+		if strings.Contains(flags, "x") {
+			expr = extended(expr)
+		}
+		if cp.plan9 {
+			var err error
+			expr, err = plan9(expr)
+			if err != nil {
+				return "", "", &vm.ParseError{
+					Pos:     n.Start(),
+					Message: err.Error(),
+				}
+			}
+			flags += "m"
+		}
+	}
+	if f := strings.Map(func(r rune) rune {
+		if strings.ContainsRune("ism", r) {
+			return r
+		}
+		return -1
+	}, flags); f != "" {
+		expr = "(?" + f + ")" + expr
+	}
+	return expr, flags, nil
+}
+
+// literal is like regexFlags, but returns a Literal, which is faster, for a
+// literal pattern that is case-sensitive. With the flag b, it returns a
+// Backtrack, which supports lookaround and backreferences, instead of a
+// regular expression. As for regexFlags, the empty pattern stands for the
+// previous one.
+func (cp *compiler) literal(n *capture.Node, flags string) (sregx.Matcher, error) {
+	if empty(n) {
+		return cp.previous(n, flags)
+	}
+	f := cp.patternFlags(n, flags)
+	if strings.Contains(f, "l") && !strings.Contains(f, "i") {
+		lit := sregx.NewLiteral([]byte(pattern(n, cp.in)))
+		cp.last = lit
+		return lit, nil
+	}
+	if !strings.Contains(f, "b") {
+		return cp.regexFlags(n, flags)
+	}
+
+	expr, f, err := cp.regexExpr(n, flags)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(f, "p") {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: "leftmost-longest matching is not supported with the b flag",
+		}
+	}
+	bt, err := sregx.CompileBacktrack(expr)
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: err.Error(),
+		}
+	}
+	bt.Err = cp.errh
+	cp.last = bt
+	return bt, nil
+}
+
+// matcher returns the matcher described by n, which is a pattern capture
+// holding a regular expression, a fuzzy capture holding an edit distance and a
+// pattern, or a words capture naming a file with one literal string per line.
+func (cp *compiler) matcher(n *capture.Node) (sregx.Matcher, error) {
+	switch n.Id {
+	case pattId:
+		return cp.literal(n, "")
+	case fuzzyId:
+		k := number(n.Children[0], cp.in)
+		patt := []byte(pattern(n.Children[1], cp.in))
+		if k < 0 || k >= utf8.RuneCount(patt) {
+			return nil, &vm.ParseError{
+				Pos:     n.Children[0].Start(),
+				Message: "edit distance must be less than the length of the pattern",
+			}
+		}
+		return sregx.NewFuzzy(patt, k), nil
+	}
+
+	name := pattern(n, cp.in)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: err.Error(),
+		}
+	}
+	defer f.Close()
+
+	words, err := sregx.ReadWords(f, false, false)
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: name + ": " + err.Error(),
+		}
+	}
+	return words, nil
+}
+
+// flags returns the flags captured by n, checking that each is one of
+// allowed.
+func (cp *compiler) flags(n *capture.Node, allowed string) (string, error) {
+	flags := string(cp.in.Slice(n.Start(), n.End()))
+	if i := strings.IndexFunc(flags, func(r rune) bool {
+		return !strings.ContainsRune(allowed, r)
+	}); i != -1 {
+		return "", &vm.ParseError{
+			Pos:     n.Start().Move(i),
+			Message: "unknown flag " + flags[i:i+1],
+		}
+	}
+	return flags, nil
+}
+
+// dict reads the mapping file named by the pattern capture n. Files with a
+// .csv extension are read as CSV, and others as tab-separated values.
+func (cp *compiler) dict(n *capture.Node, fold, word bool) (*sregx.Dict, error) {
+	name := pattern(n, cp.in)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: err.Error(),
+		}
+	}
+	defer f.Close()
+
+	comma := '\t'
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		comma = ','
+	}
+	dict, err := sregx.ReadDict(f, comma, fold, word)
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: name + ": " + err.Error(),
+		}
+	}
+	return dict, nil
+}
+
+// text returns the text of the pattern capture n, along with the counter of
+// the enclosing x command if the text refers to it or escapes a '$' with $$.
+// Outside an x command the text is literal.
+func (cp *compiler) text(n *capture.Node) ([]byte, *sregx.Counter, error) {
+	return cp.counterText(n, []byte(pattern(n, cp.in)))
+}
+
+// counterText returns t, the text of the pattern capture n, along with the
+// counter of the enclosing x command as for text.
+func (cp *compiler) counterText(n *capture.Node, t []byte) ([]byte, *sregx.Counter, error) {
+	if cp.counter == nil || !bytes.Contains(t, []byte("$#")) && !bytes.Contains(t, []byte("${#")) {
+		return t, nil, nil
+	}
+	if err := sregx.CheckCounter(t); err != nil {
+		return nil, nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: err.Error(),
+		}
+	}
+	cp.counted = true
+	return t, cp.counter, nil
+}
+
+// compileCounted compiles n with a new match counter in scope, and returns the
+// counter if n refers to it.
+func (cp *compiler) compileCounted(n *capture.Node) (sregx.Command, *sregx.Counter, error) {
+	counter, counted := cp.counter, cp.counted
+	defer func() {
+		cp.counter, cp.counted = counter, counted
+	}()
+
+	cp.counter, cp.counted = &sregx.Counter{}, false
+	cmd, err := cp.compile(n)
+	if err != nil || !cp.counted {
+		return cmd, nil, err
+	}
+	return cmd, cp.counter, nil
+}
+
+// rangeStep returns the range of the range capture n, which may have a step.
+func (cp *compiler) rangeStep(n *capture.Node) (sregx.Range, error) {
+	start, end := rangeNums(n, cp.in)
+	r := sregx.Range{
+		Start: start,
+		End:   end,
+		Step:  1,
+	}
+	if len(n.Children) > 2 {
+		r.Step = number(n.Children[2], cp.in)
+		if r.Step <= 0 {
+			return r, &vm.ParseError{
+				Pos:     n.Children[2].Start(),
+				Message: "step must be positive",
+			}
+		}
+	}
+	return r, nil
+}
+
+// subst compiles an s or S command. The flags following the replacement
+// select the occurrences to replace, either by a range as for x, or sed-style
+// by a number N, which selects the Nth occurrence, or from the Nth onward if
+// followed by g. The e flag reports an error if nothing is replaced, and the
+// regular expression flags are as for regexFlags, except that l also makes the
+// replacement literal. When compiling with Plan9, the replacement of a regular
+// expression is read by plan9Replace.
+func (cp *compiler) subst(n *capture.Node) (sregx.Command, error) {
+	s := sregx.S{
+		PreserveCase: n.Children[0].Id == keepCaseId,
+	}
+	flags, nth := "", false
+	for _, cn := range n.Children[3:] {
+		switch cn.Id {
+		case rangeId:
+			r, err := cp.rangeStep(cn)
+			if err != nil {
+				return nil, err
+			}
+			s.Select = []sregx.Range{r}
+		case numId:
+			occurrence := number(cn, cp.in)
+			if occurrence < 1 {
+				return nil, &vm.ParseError{
+					Pos:     cn.Start(),
+					Message: "occurrence must be positive",
+				}
+			}
+			s.Select = []sregx.Range{{Start: occurrence - 1, End: occurrence}}
+			nth = true
+		case flagsId:
+			var err error
+			flags, err = cp.flags(cn, "geismxlpb")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if nth && strings.Contains(flags, "g") {
+		s.Select[0].End = -1
+	}
+	if strings.Contains(flags, "e") {
+		s.Err = cp.errh
+		if s.Err == nil {
+			s.Err = printError
+		}
+	}
+
+	rflags := strings.Map(func(r rune) rune {
+		if r == 'g' || r == 'e' {
+			return -1
+		}
+		return r
+	}, flags)
+	if s.PreserveCase && !empty(n.Children[1]) {
+		rflags += "i"
+	}
+	var err error
+	s.Patt, err = cp.literal(n.Children[1], rflags)
+	if err != nil {
+		return nil, err
+	}
+	_, isRegexp := s.Patt.(sregx.Submatcher)
+	literal := strings.Contains(cp.patternFlags(n.Children[1], rflags), "l")
+	if isRegexp && !literal && cp.plan9 {
+		s.Replace = plan9Replace(n.Children[2], cp.in)
+		return s, nil
+	}
+	if isRegexp && !literal {
+		s.Replace, s.Counter, err = cp.counterText(n.Children[2], replacePattern(n.Children[2], cp.in))
+	} else {
+		s.Replace, s.Counter, err = cp.text(n.Children[2])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isRegexp && literal {
+		s.Replace = bytes.ReplaceAll(s.Replace, []byte("\\"), []byte("\\\\"))
+		s.Replace = bytes.ReplaceAll(s.Replace, []byte("$"), []byte("$$"))
+	}
+	return s, nil
+}
+
+// patternLines compiles an l command whose range has a pattern as a bound.
+// The number next to a pattern must be an offset from the line that matches
+// it: positive after a pattern at the start, and negative before one at the
+// end.
+func (cp *compiler) patternLines(n *capture.Node) (sregx.Command, error) {
+	l := sregx.L{}
+	bounds := n.Children[1].Children
+	for i, bn := range bounds {
+		if bn.Id == numId {
+			continue
+		}
+		patt, err := cp.matcher(bn)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			l.StartPatt = patt
+		} else {
+			l.EndPatt = patt
+		}
+	}
+	switch {
+	case bounds[0].Id == numId:
+		if cp.in.Slice(bounds[0].Start(), bounds[0].End())[0] != '-' {
+			return nil, &vm.ParseError{
+				Pos:     bounds[0].Start(),
+				Message: "the start of a range ending with a pattern must be an offset such as -3",
+			}
+		}
+		l.Start = number(bounds[0], cp.in)
+	case bounds[1].Id == numId:
+		if cp.in.Slice(bounds[1].Start(), bounds[1].End())[0] != '+' {
+			return nil, &vm.ParseError{
+				Pos:     bounds[1].Start(),
+				Message: "the end of a range starting with a pattern must be a pattern or an offset such as +3",
+			}
+		}
+		l.End = number(bounds[1], cp.in)
+	}
+
+	var err error
+	cp.pieces = true
+	l.Cmd, err = cp.compile(n.Children[2])
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// pipeline compiles a pipeline capture. A pipeline of a single command is
+// compiled to just that command.
+func (cp *compiler) pipeline(n *capture.Node) (sregx.Command, error) {
+	cmds := make(sregx.CommandPipeline, len(n.Children))
+	for i, cn := range n.Children {
+		var err error
+		cmds[i], err = cp.compile(cn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cmds) == 1 {
+		return cmds[0], nil
+	}
+	return cmds, nil
+}
+
+// numeric compiles a g or v command with a numeric condition.
+func (cp *compiler) numeric(n *capture.Node) (sregx.Command, error) {
+	cond, err := cp.cond(n.Children[1])
+	if err != nil {
+		return nil, err
+	}
+	var key *regexp.Regexp
+	if n.Children[2].Id == pattId {
+		key, err = cp.regex(n.Children[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+	cmd, err := cp.compile(n.Children[len(n.Children)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	if n.Children[0].Id == gId {
+		return sregx.GNum{
+			Cond: cond,
+			Key:  key,
+			Cmd:  cmd,
+		}, nil
+	}
+	return sregx.VNum{
+		Cond: cond,
+		Key:  key,
+		Cmd:  cmd,
+	}, nil
+}
+
+// cond returns the condition described by the condition capture n.
+func (cp *compiler) cond(n *capture.Node) (sregx.Cond, error) {
+	var nums []float64
+	for _, cn := range n.Children {
+		if cn.Id != floatId {
+			continue
+		}
+		f, err := strconv.ParseFloat(string(cp.in.Slice(cn.Start(), cn.End())), 64)
+		if err != nil {
+			return nil, &vm.ParseError{
+				Pos:     cn.Start(),
+				Message: err.Error(),
+			}
+		}
+		nums = append(nums, f)
+	}
+
+	if n.Children[0].Id != opId {
+		lo, hi := nums[0], nums[1]
+		return func(f float64) bool {
+			return f >= lo && f <= hi
+		}, nil
+	}
+
+	x := nums[0]
+	switch string(cp.in.Slice(n.Children[0].Start(), n.Children[0].End())) {
+	case ">=":
+		return func(f float64) bool { return f >= x }, nil
+	case "<=":
+		return func(f float64) bool { return f <= x }, nil
+	case "==":
+		return func(f float64) bool { return f == x }, nil
+	case "!=":
+		return func(f float64) bool { return f != x }, nil
+	case ">":
+		return func(f float64) bool { return f > x }, nil
+	default: // "<"
+		return func(f float64) bool { return f < x }, nil
+	}
+}
+
+func (cp *compiler) compile(n *capture.Node) (sregx.Command, error) {
+	var c sregx.Command
+	pieces := cp.pieces
+	cp.pieces = false
+
+	id := n.Children[0].Id
+	switch id {
+	case aId, iId, mId:
+		// These commands were added after user commands, which take
+		// precedence when they share a name, so that existing user commands
+		// keep working. A user command has no flags. The same holds for S
+		// through the grammar.
+		name := string(cp.in.Slice(n.Children[0].Start(), n.Children[0].End()))
+		if _, ok := cp.usrfns[name]; ok && n.Children[1].Id != flagsId {
+			return cp.user(n.Children[0], n.Children[1])
+		}
+	}
+
+	switch id {
+	case sortId, uniqId, reverseId, shuffleId, countId, sumId, avgId, minId, maxId, longestId, shortestId:
+		if !pieces {
+			return nil, &vm.ParseError{
+				Pos:     n.Start(),
+				Message: string(cp.in.Slice(n.Children[0].Start(), n.Children[0].End())) + " must be the command of an x or y, or of an n or l that selects pieces",
+			}
+		}
+	}
+
+	switch id {
+	case xId, yId, gId, vId:
+		if n.Children[1].Id == condId {
+			return cp.numeric(n)
+		}
+		patt, err := cp.matcher(n.Children[1])
+		if err != nil {
+			return nil, err
+		}
+		var sel []sregx.Range
+		if (id == xId || id == yId) && n.Children[2].Id == rangeId {
+			r, err := cp.rangeStep(n.Children[2])
+			if err != nil {
+				return nil, err
+			}
+			sel = []sregx.Range{r}
+		}
+		last := n.Children[len(n.Children)-1]
+		if id == xId || id == yId {
+			selected := cp.selected
+			cp.selected = true
+			defer func() {
+				cp.selected = selected
+			}()
+			cp.pieces = true
+		}
+		if id == xId {
+			cmd, counter, err := cp.compileCounted(last)
+			if err != nil {
+				return nil, err
+			}
+			c = sregx.X{
+				Patt:    patt,
+				Cmd:     cmd,
+				Select:  sel,
+				Counter: counter,
 			}
 		} else {
-			cmd, err := compile(n.Children[2], in, out, usrfns)
+			cmd, err := cp.compile(last)
 			if err != nil {
 				return nil, err
 			}
 			switch id {
-			case xId:
-				c = sregx.X{
-					Patt: regex,
-					Cmd:  cmd,
-				}
 			case yId:
 				c = sregx.Y{
-					Patt: regex,
-					Cmd:  cmd,
+					Patt:   patt,
+					Cmd:    cmd,
+					Select: sel,
 				}
 			case gId:
 				c = sregx.G{
-					Patt: regex,
+					Patt: patt,
 					Cmd:  cmd,
 				}
 			case vId:
 				c = sregx.V{
-					Patt: regex,
+					Patt: patt,
 					Cmd:  cmd,
 				}
 			}
 		}
-	case cId:
-		c = sregx.C{
-			Change: []byte(pattern(n.Children[1], in)),
+	case sId, keepCaseId:
+		return cp.subst(n)
+	case cId, aId, iId:
+		text, counter, err := cp.text(n.Children[1])
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case cId:
+			c = sregx.C{
+				Change:  text,
+				Counter: counter,
+			}
+		case aId:
+			c = sregx.A{
+				Text:    text,
+				Counter: counter,
+			}
+		case iId:
+			c = sregx.I{
+				Text:    text,
+				Counter: counter,
+			}
+		}
+	case mId:
+		flags := ""
+		if n.Children[1].Id == flagsId {
+			var err error
+			flags, err = cp.flags(n.Children[1], "iw")
+			if err != nil {
+				return nil, err
+			}
+		}
+		dict, err := cp.dict(n.Children[len(n.Children)-1], strings.Contains(flags, "i"), strings.Contains(flags, "w"))
+		if err != nil {
+			return nil, err
+		}
+		c = sregx.M{
+			Dict:  dict,
+			Whole: cp.selected,
 		}
 	case nId, lId:
-		start, end := rangeNums(n.Children[1], in)
-		cmd, err := compile(n.Children[2], in, out, usrfns)
+		if n.Children[1].Id == prangeId {
+			return cp.patternLines(n)
+		}
+		// A single range without a step is a plain slice, and any other
+		// ranges select pieces.
+		var ranges []sregx.Range
+		for _, rn := range n.Children[1].Children {
+			r, err := cp.rangeStep(rn)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r)
+		}
+		var start, end int
+		if len(ranges) == 1 && len(n.Children[1].Children[0].Children) == 2 {
+			start, end = ranges[0].Start, ranges[0].End
+			ranges = nil
+		}
+		cp.pieces = ranges != nil
+		cmd, err := cp.compile(n.Children[2])
 		if err != nil {
 			return nil, err
 		}
 		if id == nId {
 			c = sregx.N{
-				Start: start,
-				End:   end,
-				Cmd:   cmd,
+				Start:  start,
+				End:    end,
+				Cmd:    cmd,
+				Ranges: ranges,
 			}
 		} else { // lId
 			c = sregx.L{
-				Start: start,
-				End:   end,
-				Cmd:   cmd,
+				Start:  start,
+				End:    end,
+				Cmd:    cmd,
+				Ranges: ranges,
 			}
 		}
-	case pId:
-		c = sregx.P{
-			W: out,
+	case switchId:
+		sw := sregx.Switch{}
+		for _, cn := range n.Children[1:] {
+			if sw.Default != nil {
+				return nil, &vm.ParseError{
+					Pos:     cn.Start(),
+					Message: "default must be the last case",
+				}
+			}
+			if cn.Id == defaultId {
+				cmd, err := cp.pipeline(cn.Children[0])
+				if err != nil {
+					return nil, err
+				}
+				sw.Default = cmd
+				continue
+			}
+			patt, err := cp.matcher(cn.Children[0])
+			if err != nil {
+				return nil, err
+			}
+			cmd, err := cp.pipeline(cn.Children[1])
+			if err != nil {
+				return nil, err
+			}
+			sw.Cases = append(sw.Cases, sregx.Case{
+				Patt: patt,
+				Cmd:  cmd,
+			})
 		}
-	case dId:
-		c = sregx.D{}
-	case uId:
-		name := string(in.Slice(n.Children[0].Start(), n.Children[0].End()))
-		def := pattern(n.Children[1], in)
-		fn, ok := usrfns[name]
-		if !ok {
-			return nil, &vm.ParseError{
-				Pos:     n.Children[0].Start(),
-				Message: "no function defined for " + name,
+		c = sw
+	case loopId:
+		max := defaultLoopMax
+		if n.Children[1].Id == numId {
+			max = number(n.Children[1], cp.in)
+			if max < 1 {
+				return nil, &vm.ParseError{
+					Pos:     n.Children[1].Start(),
+					Message: "loop limit must be positive",
+				}
 			}
 		}
-		eval, err := fn(def)
+		cmd, err := cp.pipeline(n.Children[len(n.Children)-1])
 		if err != nil {
+			return nil, err
+		}
+		c = sregx.Loop{
+			Cmd: cmd,
+			Max: max,
+			Err: cp.errh,
+		}
+	case sortId, uniqId:
+		flags := ""
+		var key *regexp.Regexp
+		for _, cn := range n.Children[1:] {
+			switch cn.Id {
+			case flagsId:
+				allowed := "i"
+				if id == sortId {
+					allowed = "inr"
+				}
+				var err error
+				flags, err = cp.flags(cn, allowed)
+				if err != nil {
+					return nil, err
+				}
+			case pattId:
+				regex, err := cp.regex(cn)
+				if err != nil {
+					return nil, err
+				}
+				key = regex
+			}
+		}
+		if id == sortId {
+			c = sregx.Sort{
+				Key:     key,
+				Numeric: strings.Contains(flags, "n"),
+				Fold:    strings.Contains(flags, "i"),
+				Reverse: strings.Contains(flags, "r"),
+			}
+		} else {
+			c = sregx.Uniq{
+				Key:  key,
+				Fold: strings.Contains(flags, "i"),
+			}
+		}
+	case countId, sumId, avgId, minId, maxId, longestId, shortestId:
+		var key *regexp.Regexp
+		var cmd sregx.Command
+		for _, cn := range n.Children[1:] {
+			var err error
+			switch cn.Id {
+			case pattId:
+				key, err = cp.regex(cn)
+			case cmdId:
+				cmd, err = cp.compile(cn)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch id {
+		case countId:
+			c = sregx.Count{Cmd: cmd}
+		case sumId:
+			c = sregx.Sum{Key: key, Cmd: cmd}
+		case avgId:
+			c = sregx.Avg{Key: key, Cmd: cmd}
+		case minId:
+			c = sregx.Min{Key: key, Cmd: cmd}
+		case maxId:
+			c = sregx.Max{Key: key, Cmd: cmd}
+		case longestId:
+			c = sregx.Longest{Cmd: cmd}
+		case shortestId:
+			c = sregx.Shortest{Cmd: cmd}
+		}
+	case recaseId:
+		name := pattern(n.Children[1], cp.in)
+		style, ok := styles[name]
+		if !ok {
 			return nil, &vm.ParseError{
 				Pos:     n.Children[1].Start(),
-				Message: err.Error(),
+				Message: "unknown case style " + name,
 			}
 		}
-
-		c = sregx.U{
-			Evaluator: eval,
+		c = sregx.Recase{
+			Style: style,
+		}
+	case reverseId:
+		c = sregx.Reverse{}
+	case shuffleId:
+		shuffle := sregx.Shuffle{}
+		if len(n.Children) > 1 {
+			seed := number(n.Children[1], cp.in)
+			shuffle.Rand = rand.New(rand.NewSource(int64(seed)))
+		}
+		c = shuffle
+	case arithId:
+		operand, _ := strconv.ParseFloat(string(cp.in.Slice(n.Children[1].Start(), n.Children[1].End())), 64)
+		c = sregx.Arith{
+			Op:      cp.in.Slice(n.Children[0].Start(), n.Children[0].End())[0],
+			Operand: operand,
+			Err:     cp.errh,
+		}
+	case pId:
+		c = sregx.P{
+			W: cp.out,
 		}
+	case dId:
+		c = sregx.D{}
+	case uId:
+		return cp.user(n.Children[0], n.Children[1])
 	}
 
 	return c, nil
 }
+
+// user compiles the user command named by the capture n, whose definition is
+// the pattern capture def.
+func (cp *compiler) user(n, def *capture.Node) (sregx.Command, error) {
+	name := string(cp.in.Slice(n.Start(), n.End()))
+	fn, ok := cp.usrfns[name]
+	if !ok {
+		return nil, &vm.ParseError{
+			Pos:     n.Start(),
+			Message: "no function defined for " + name,
+		}
+	}
+	eval, err := fn(pattern(def, cp.in))
+	if err != nil {
+		return nil, &vm.ParseError{
+			Pos:     def.Start(),
+			Message: err.Error(),
+		}
+	}
+	return sregx.U{
+		Evaluator: eval,
+	}, nil
+}
@@ -3,6 +3,9 @@ package syntax_test
 import (
 	"bytes"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/zyedidia/sregx"
@@ -54,3 +57,766 @@ func TestCVar(t *testing.T) {
 
 	check(cmd, tests, t)
 }
+
+func TestSwitch(t *testing.T) {
+	cmd, err := syntax.Compile(`x/[a-zA-Z0-9]+/ switch { /^[0-9]+$/ c/N/ ; /^[A-Z]/ s/[a-z]/_/ | s/_/-/ ; default d }`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []Test{
+		{"switch1", "12 Abc def 3x", "N A--  "},
+		{"switch2", "A1 99", "A1 N"},
+	}
+
+	check(cmd, tests, t)
+
+	cmd, err = syntax.Compile(`x/\S+/ switch { 'a.b' c/L/ ; /(a)\1/b c/B/ ; ~1/xyz/ c/F/ ; /^q$/i c/I/ }`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"matchers", "a.b axb aa xyy Q", "L axb B F I"},
+	}, t)
+
+	if _, err := syntax.Compile(`switch { default p ; /a/ d }`, ioutil.Discard, nil); err == nil {
+		t.Error("expected error for default before last case")
+	}
+}
+
+func TestLoop(t *testing.T) {
+	cmd, err := syntax.Compile(`loop { x/\n\n\n/ c/\n\n/ }`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"loop1", "a\n\n\n\n\nb\n\n\nc\n", "a\n\nb\n\nc\n"},
+	}, t)
+
+	var errs []error
+	cmd, err = syntax.Compile(`loop[2] { s/a/aa/ }`, ioutil.Discard, nil, syntax.OnError(func(err error) {
+		errs = append(errs, err)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"loop2", "a", "aaaa"},
+	}, t)
+	if len(errs) != 1 {
+		t.Errorf("got %d errors, want 1", len(errs))
+	}
+
+	if _, err := syntax.Compile(`loop[0] { s/^/a/ }`, ioutil.Discard, nil); err == nil {
+		t.Error("expected error for loop[0]")
+	}
+}
+
+func TestCounter(t *testing.T) {
+	cmd, err := syntax.Compile(`x/[0-9]+/ s/.+/[${#:%d:1}]/ | x/.*\n/ g/./ i/$#: /`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"counter1", "a 7\n\nb 42\n", "0: a [1]\n\n2: b [2]\n"},
+	}, t)
+
+	literal := []struct {
+		expr string
+		want string
+	}{
+		{`c/cost: $#/`, "cost: $#"},
+		{`x/a/ c/$$# $$ $#/`, "$# $$ 0"},
+		{`x/a/ c/$$/`, "$$"},
+		{`x/a/ c/$$${#}$1/`, "$$0$1"},
+		{`x/a/ s/a/$$#/`, "$#"},
+	}
+	for _, tt := range literal {
+		cmd, err := syntax.Compile(tt.expr, ioutil.Discard, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if out := string(cmd.Evaluate([]byte("a"))); out != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.expr, out, tt.want)
+		}
+	}
+
+	for _, expr := range []string{`x/a/ c/${#:%s}/`, `x/a/ c/${#:%d%d}/`, `x/a/ a/${#:%d:a}/`, `x/a/ s/a/${##:%d:1}/`} {
+		if _, err := syntax.Compile(expr, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected error for invalid counter reference", expr)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	cmd, err := syntax.Compile(`x/TODO/[0:1] c/FIXME/ | x/.*\n/[-3:-1] y/ /[1:2] s/[a-z]+/*/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"select1", "TODO a\nTODO b\nc d\n", "FIXME a\nTODO *\nc *\n"},
+	}, t)
+
+	if _, err := syntax.Compile(`x/a/[0:1:0] p`, ioutil.Discard, nil); err == nil {
+		t.Error("expected error for zero step")
+	}
+}
+
+func TestCollective(t *testing.T) {
+	tests := []struct {
+		expr  string
+		input string
+		want  string
+	}{
+		{`x/.*\n/ sort`, "b\nc\na\n", "a\nb\nc\n"},
+		{`x/[0-9]+/ sort[nr]`, "2 10 1", "10 2 1"},
+		{`x/.*\n/ sort/ (.*)/`, "a z\nb y\n", "b y\na z\n"},
+		{`x/[a-zA-Z]+/ uniq[i]`, "a b A c", "a b c "},
+		{`y/ /[1:-2] reverse`, "a b c d", "a c b d"},
+		{`x/[a-z]/ shuffle[1] | x/[a-z]/ sort`, "d c b a", "a b c d"},
+		{`n[0:7:2]reverse`, "d c b a", "a b c d"},
+		{`l[/c/:/d/]count`, "a\nc\nd\nc\n", "a\n2"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.expr, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(cmd, []Test{{tt.expr, tt.input, tt.want}}, t)
+	}
+
+	if _, err := syntax.Compile(`x/a/ uniq[n]`, ioutil.Discard, nil); err == nil {
+		t.Error("expected error for unknown flag")
+	}
+
+	// Outside the selections of a command, these commands are errors.
+	for _, s := range []string{`sort`, `count`, `x/a/ g/a/ reverse`, `n[0:2]shuffle`, `x/a/ sum p | uniq`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestReduce(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cmd, err := syntax.Compile(`x/.*\n/ sum/ ([0-9]+)/ p | x/[a-z]+/ count`, buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"reduce", "a 1\nb 2\nc 3\n", "6"},
+	}, t)
+	if buf.String() != "6" {
+		t.Errorf("printed %q, want %q", buf.String(), "6")
+	}
+}
+
+func TestArith(t *testing.T) {
+	cmd, err := syntax.Compile(`x/[0-9.]+/ +1 | x/v[0-9]+/ n[1:-1]*10 | x/-[0-9]+/ -0.5`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"arith", "v1 1.5 008 line -2", "v20 2.5 009 line -3.5"},
+	}, t)
+}
+
+func TestNumGuard(t *testing.T) {
+	cmd, err := syntax.Compile(`x/[^\n]+/ g[>100]/ ([0-9.]+)/ a/ big/ | x/[^\n]+/ v[1..10] i/- /`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"guard", "a 150\nb 5\n7", "- a 150 big\n- b 5\n7"},
+	}, t)
+
+	cmd, err = syntax.Compile(`x/[0-9]+/ g[ > 5 ] c/big/ | x/[0-9]+/ v[ 1 .. 3 ] c/out/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"spaces", "1 4 9", "1 out big"},
+	}, t)
+
+	for _, s := range []string{`g[>x] p`, `g[1 2] p`, `g[>1 p`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	tag := func(s string) (sregx.Evaluator, error) {
+		return func(b []byte) []byte {
+			return []byte(s + ":" + string(b))
+		}, nil
+	}
+	usrfns := map[string]syntax.EvalMaker{"a": tag, "i": tag, "m": tag, "S": tag, "u": tag}
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`u/x/`, "x:in"},
+		{`a/x/`, "x:in"},
+		{`i/x/`, "x:in"},
+		{`m/x/`, "x:in"},
+		{`S/x/ | u/y/`, "y:x:in"},
+		{`S/in/out/`, "out"},
+		{`c/in/ | i/x/`, "x:in"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.expr, ioutil.Discard, usrfns)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if out := string(cmd.Evaluate([]byte("in"))); out != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.expr, out, tt.want)
+		}
+	}
+}
+
+func TestDict(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "renames.tsv")
+	if err := ioutil.WriteFile(file, []byte("foo\tbar\nbar\tbaz\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	file = strings.ReplaceAll(file, "/", `\/`)
+
+	cmd, err := syntax.Compile("x/q[a-zA-Z]+/ m[i]/"+file+"/ | m[w]/"+file+"/", ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"dict", "foo bar foobar qFOOx", "bar baz foobar qFOOx"},
+	}, t)
+
+	cmd, err = syntax.Compile("x/[a-z]+/ m/"+file+"/", ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"whole", "foo foobar barbar bar", "bar foobar barbar baz"},
+	}, t)
+
+	for _, s := range []string{"m[z]/" + file + "/", "m/does-not-exist.tsv/"} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "banned.txt")
+	if err := ioutil.WriteFile(file, []byte("gets\nstrcpy\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := syntax.Compile("x@"+file+"@ a/!/ | y@"+file+"@ x/[a-z]+/ c/_/", ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"words", "strcpy(a, gets(b))", "strcpy!(_, gets!(_))"},
+	}, t)
+}
+
+func TestFuzzy(t *testing.T) {
+	cmd, err := syntax.Compile(`x/[^\n]+/ g~1/colour/ x~2/receive/ c/receive/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"fuzzy", "color: recieve\nflavor: recieve", "color: receive\nflavor: recieve"},
+	}, t)
+
+	for _, s := range []string{`x~3/abc/ d`, `x~-1/abc/ d`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestKeepCase(t *testing.T) {
+	cmd, err := syntax.Compile(`S/old_name/new_id/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"keepcase", "old_name Old_name OLD_NAME oLD_name", "new_id New_id NEW_ID new_id"},
+	}, t)
+}
+
+func TestRecase(t *testing.T) {
+	cmd, err := syntax.Compile(`x/\b[a-z]+(_[a-z]+)+\b/ case/camel/ | x/\b[A-Z][A-Z]+[a-z]\w*/ case/kebab/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"recase", "max_line_len HTTPServer", "maxLineLen http-server"},
+	}, t)
+
+	if _, err := syntax.Compile(`case/title/`, ioutil.Discard, nil); err == nil {
+		t.Error("expected an error for an unknown style")
+	}
+}
+
+func TestCaseModifiers(t *testing.T) {
+	cmd, err := syntax.Compile(`s/([a-z]+)_(\w)/$1\u$2/ | s/^(\w+)/\U$1\E:/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(cmd, []Test{
+		{"word", "max_len", "MAXLEN:"},
+		{"words", "id max_len", "ID: maxLen"},
+	}, t)
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{`s/a/\\U/`, `\Ub`},
+		{`s/(a)/\\\U$1/`, `\Ab`},
+		{`s/a/\x5cu/`, `\ub`},
+		{`s/a/\\U/l`, `\Ub`},
+	}
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.expr, ioutil.Discard, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if out := string(cmd.Evaluate([]byte("ab"))); out != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.expr, out, tt.want)
+		}
+	}
+}
+
+func TestSubstFlags(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`s/a/b/2`, "a b a a"},
+		{`s/a/b/3g`, "a a b b"},
+		{`s/a/b/[0:2]`, "b b a a"},
+		{`s/a/b/g`, "b b b b"},
+		{`S/A/b/1`, "b a a a"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(cmd, []Test{{tt.cmd, "a a a a", tt.want}}, t)
+	}
+
+	var errs []error
+	cmd, err := syntax.Compile(`s/z/b/e | s/a/b/1e`, ioutil.Discard, nil, syntax.OnError(func(err error) {
+		errs = append(errs, err)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cmd, []Test{{"e", "a", "b"}}, t)
+	if len(errs) != 1 {
+		t.Errorf("got errors %v, want one", errs)
+	}
+
+	// Without a handler, the e flag writes its error to standard error.
+	cmd, err = syntax.Compile(`s/z/b/e`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	stderr := os.Stderr
+	os.Stderr = f
+	cmd.Evaluate([]byte("a"))
+	os.Stderr = stderr
+	f.Close()
+	if out, err := ioutil.ReadFile(f.Name()); err != nil || !strings.Contains(string(out), "no match") {
+		t.Errorf("got %q on standard error, want a no match error", out)
+	}
+
+	for _, s := range []string{`s/a/b/0`, `s/a/b/z`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestDelimiters(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		input string
+		want  string
+	}{
+		{`x|/usr/lib| c|/opt|`, "/usr/lib/x", "/opt/x"},
+		{`s#a/b#c/d#`, "a/b", "c/d"},
+		{`s,a\,b,c,`, "a,b", "c"},
+		{`x.a\.b. c/_/`, "a.b axb", "_ axb"},
+		{`x/foo/i c/bar/`, "Foo FOO", "bar bar"},
+		{`s/foo/bar/gi`, "Foo FOO", "bar bar"},
+		{`x/^a/m c/b/`, "a\na", "b\nb"},
+		{`x/a.b/s c/_/`, "a\nb", "_"},
+		{`x/a.b/l c/_/`, "a.b axb", "_ axb"},
+		{`s/$1/$2/l`, "$1", "$2"},
+		{`x/a b # comment
+		    c/x c/_/`, "abc", "_"},
+		{`x/[ ]a\\ b/x c/_/`, " a b", "_"},
+		{`x/a/i/b/`, "a", "ba"},
+		{`x/a/ sort/[0-9]+/i`, "", ""},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, tt.input, tt.want}}, t)
+	}
+
+	for _, s := range []string{`x[a[ p`, `x|a p`, `s/a/b/q`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestFixedStrings(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		input string
+		want  string
+	}{
+		{`x'a.b(c)' c/_/`, "a.b(c) axb(c)", "_ axb(c)"},
+		{`x'it\'s' c/_/`, "it's", "_"},
+		{`s'a.b'$1'`, "a.b axb", "$1 axb"},
+		{`g'a.b'i c/_/`, "A.B", "_"},
+		{`v'a.b' c/_/`, "axb", "_"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, tt.input, tt.want}}, t)
+	}
+
+	cmd, err := syntax.Compile(`x/a.b/ s/./$0$0/`, ioutil.Discard, nil, syntax.FixedStrings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cmd, []Test{{"fixed", "a.b axb", "a$0$0b axb"}}, t)
+}
+
+func TestLongest(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`x/a|ab/ c/X/`, "Xb"},
+		{`x/a|ab/p c/X/`, "X"},
+		{`s/a|ab/X/p`, "X"},
+		{`s/a|ab/X/gp`, "X"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, "ab", tt.want}}, t)
+	}
+
+	cmd, err := syntax.Compile(`x/a|ab/ c/X/`, ioutil.Discard, nil, syntax.Longest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(cmd, []Test{{"option", "ab", "X"}}, t)
+
+	// A p that ends the command is the p command rather than a flag.
+	prints := []struct {
+		cmd  string
+		want string
+	}{
+		{`x/foo/p`, "foo"},
+		{`x/.*\n/ g/string/p`, "a string\n"},
+		{`x/.*\n/ g/rob/ v/robot/p`, "rob\n"},
+		{`g/rob/p | d`, "a string\nrobot\nrob\nfoo\n"},
+		{`x/.*\n/ sum/\d+/p`, "0"},
+	}
+	for _, tt := range prints {
+		var buf bytes.Buffer
+		cmd, err := syntax.Compile(tt.cmd, &buf, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		cmd.Evaluate([]byte("a string\nrobot\nrob\nfoo\n"))
+		if buf.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.cmd, buf.String(), tt.want)
+		}
+	}
+}
+
+func TestPlan9(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		input string
+		want  string
+	}{
+		{`x/o{2}/ c/X/`, "oo o{2}", "oo X"},
+		{`x/^a/ c/X/`, "a\na", "X\nX"},
+		{`x/[^a]+/ c/X/`, "ab\nb", "aX\nX"},
+		{`x/\./ c/X/`, "a.b", "aXb"},
+		{`x/[\]x]/ c/X/`, "a]x", "aXX"},
+		{`s/(a)(b)/\2\1/`, "ab", "ba"},
+		{`s/b/[&]/g`, "abcb", "a[b]c[b]"},
+		{`s/b/\&$1/`, "b", "&$1"},
+		{`s/(a)/\14/`, "a", "a4"},
+		{`s/(a)(b)(c)(d)(e)(f)(g)(h)(i)/\9\8/`, "abcdefghi", "ih"},
+		{`s/(a)/\\U\1/`, "a", `\Ua`},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil, syntax.Plan9())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, tt.input, tt.want}}, t)
+	}
+
+	for _, s := range []string{`x/\d/ p`, `x/a*?/ p`, `x/(?i)a/ p`, `x/[]/ p`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil, syntax.Plan9()); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestSam(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`,x/foo/c/bar/`, "bar bar\nbaz bar\n"},
+		{`,x/^/a/> /`, "> foo bar\n> baz foo\n> "},
+		{`/baz/,$d`, "foo bar\n"},
+		{`2d`, "foo bar\n"},
+		{`x/(f)(o)o/s/(f)o/\1&/`, "ffoo bar\nbaz ffoo\n"},
+		{`s2/foo/X/`, "foo bar\nbaz X\n"},
+		{`s/o/0/g`, "f00 bar\nbaz f00\n"},
+		{`x v/baz/d`, "baz foo\n"},
+		{"x/foo/{\ni/</\na/>/\n}", "<foo> bar\nbaz <foo>\n"},
+		{"1a\nnew\n.\n", "foo bar\nnew\nbaz foo\n"},
+		{`x|a\|b| c/X/`, "foo XXr\nXXz foo\n"},
+		{`,s/a/\\Uyz/`, "foo b\\Uyzr\nbaz foo\n"},
+		{`,s/a/\\\\/`, "foo b\\\\r\nbaz foo\n"},
+		{`,s/a/$1/`, "foo b$1r\nbaz foo\n"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.CompileSam(tt.cmd, ioutil.Discard)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, "foo bar\nbaz foo\n", tt.want}}, t)
+	}
+
+	var buf bytes.Buffer
+	cmd, err := syntax.CompileSam(`/baz/=`, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Evaluate([]byte("foo bar\nbaz foo\n"))
+	if buf.String() != "2; #8,#11\n" {
+		t.Errorf("got %q, want %q", buf.String(), "2; #8,#11\n")
+	}
+
+	for _, s := range []string{`,w out`, `,x/a/=`, `'a d`, `x/a/ q`, `s/\d/x/`} {
+		if _, err := syntax.CompileSam(s, ioutil.Discard); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestBacktrack(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`x/\b(\w+) \1\b/b c/X/`, "X cat"},
+		{`x/\w+(?= cat)/b c/X/`, "the X cat"},
+		{`s/(?<=the )(\w+)/[$1]/b`, "the [the] [cat]"},
+		{`s/(?i)(?<w>T\w+) \k<w>/X/b`, "X cat"},
+		{`x/^\w+$/bm c/X/`, "the the cat"},
+		{`g/(\w)\1/b c/X/`, "the the cat"},
+		{`x'(?'ib c/X/`, "the the cat"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, "the the cat", tt.want}}, t)
+	}
+
+	for _, s := range []string{`x/(?<=a)/ c/X/`, `x/a/bp c/X/`, `x/(a)\2/b c/X/`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	tests := []struct {
+		cmd   string
+		input string
+		want  string
+	}{
+		{`x/\x41/ c/\x42/`, "xAy", "xBy"},
+		{`x/\x2e/ c/X/`, "a.b", "aXb"},
+		{`x/\56/ c/X/`, "a.b", "aXb"},
+		{`x/é/ c/\u{1F600}/`, "café", "caf😀"},
+		{`x/\e\[1m/ d`, "\x1b[1mbold", "bold"},
+		{`x/\a/ c/\0/`, "a\ab", "a\x00b"},
+		{`x'\377' c/\101/`, "a\xffb", "aAb"},
+		{`s/(a)/\u$1\x21/`, "ab", "A!b"},
+		{`s/a/\u{e9}/`, "ab", "éb"},
+		{`x/\u{0}/ c/\u{00010FFFF}/`, "a\x00b", "a\U0010FFFFb"},
+		{`s/(\w+)/\Ucafebabe/`, "x", "CAFEBABE"},
+		{`s/(\w+)/\ucafe/`, "x", "Cafe"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, tt.input, tt.want}}, t)
+	}
+
+	for _, s := range []string{`x/\xg1/ d`, `x/\u{d800}/ d`, `x/\u{110000}/ d`, `x/\u{}/ d`, `x/\u{41/ d`, `c/\q/`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestPreviousPattern(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`x/[a-z]+/ g// c/X/`, "X X 12"},
+		{`x/\d+/ c/N/ | s//M/`, "foo bar N"},
+		{`y/o+/i v// c/X/`, "XooX"},
+		{`x/o/ s//0/g`, "f00 bar 12"},
+		{`x/ / sort/\w+/ | x// c/X/`, "X X X"},
+		{`x/ba(r)/ s//$1/`, "foo r 12"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, "foo bar 12", tt.want}}, t)
+	}
+
+	cmd, err := syntax.Compile(`x/[a-z]+/ g// c/X/`, ioutil.Discard, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := cmd.(sregx.CommandPipeline)[0].(sregx.X)
+	if x.Patt != x.Cmd.(sregx.G).Patt {
+		t.Error("the previous pattern was compiled again")
+	}
+
+	for _, s := range []string{`x// d`, `x/a/ g//i d`, `x'a' sort// `, `s/a/b/ | s//c/i`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestPatternLines(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`l[/^BEGIN/:/^END/]d`, "a\nb\nc\n"},
+		{`l[/^BEGIN/:+1]x/\n/ c/;/`, "a\nBEGIN;x;END\nb\nBEGIN;y;END\nc\n"},
+		{`l[-1:/^END/]s/^/> /`, "a\nBEGIN\n> x\nEND\nb\nBEGIN\n> y\nEND\nc\n"},
+		{`l['BEGIN':'END']count`, "a\n2c\n"},
+	}
+
+	text := "a\nBEGIN\nx\nEND\nb\nBEGIN\ny\nEND\nc\n"
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, text, tt.want}}, t)
+	}
+
+	for _, s := range []string{`l[/a/:3]d`, `l[2:/a/]d`, `l[/a/:/b/`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestRangeLists(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`l[0:-1:2]c/X\n/`, "X\nb\nX\nd\nX\n"},
+		{`l[1:2,3:4]c/X\n/`, "a\nX\nc\nX\ne\n"},
+		{`l[0:2]c/X\n/`, "X\nc\nd\ne\n"},
+		{`n[0:-1:2]c/_/`, "_\n_\n_\n_\n_\n"},
+		{`n[0:1,-2:-1]c/_/`, "_\nb\nc\nd\ne_"},
+	}
+
+	for _, tt := range tests {
+		cmd, err := syntax.Compile(tt.cmd, ioutil.Discard, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.cmd, err)
+		}
+		check(cmd, []Test{{tt.cmd, "a\nb\nc\nd\ne\n", tt.want}}, t)
+	}
+
+	for _, s := range []string{`l[0:2:0]p`, `l[1:2,]p`, `n[1]p`} {
+		if _, err := syntax.Compile(s, ioutil.Discard, nil); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
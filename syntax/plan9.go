@@ -0,0 +1,165 @@
+package syntax
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zyedidia/gpeg/capture"
+	"github.com/zyedidia/gpeg/input"
+)
+
+// plan9 translates a regular expression written in the Plan 9 syntax used by
+// sam and acme to the Go syntax. The Plan 9 syntax has fewer constructs: there
+// are no repetition counts, so braces are literal, and no escapes other than
+// \n, so a backslash makes any other character literal. A negated character
+// class does not match a newline. Since ^ and $ match at line boundaries, the
+// result should be compiled with the m flag.
+//
+// Escapes of letters and digits, which would mean something else in the Go
+// syntax, and Go constructs that are errors in the Plan 9 syntax, such as (?
+// or a repeated operator, are reported as errors rather than translated.
+func plan9(expr string) (string, error) {
+	var b strings.Builder
+	op := false // the previous token is a repetition operator
+	for i := 0; i < len(expr); {
+		r, size := utf8.DecodeRuneInString(expr[i:])
+		i += size
+
+		switch r {
+		case '\\':
+			e, err := plan9Escape(expr, &i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(e)
+		case '[':
+			class, err := plan9Class(expr, &i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(class)
+		case '{', '}':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '(':
+			if strings.HasPrefix(expr[i:], "?") {
+				return "", errors.New("(? is not supported in the Plan 9 syntax")
+			}
+			b.WriteRune(r)
+		case '*', '+', '?':
+			if op {
+				return "", errors.New("repeated operator " + string(r) + " is not supported in the Plan 9 syntax")
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+		op = r == '*' || r == '+' || r == '?'
+	}
+	return b.String(), nil
+}
+
+// plan9Escape translates the escape following the backslash that ends at
+// expr[*i], and advances *i past it.
+func plan9Escape(expr string, i *int) (string, error) {
+	if *i == len(expr) {
+		return "", errors.New("trailing backslash")
+	}
+	r, size := utf8.DecodeRuneInString(expr[*i:])
+	*i += size
+	switch {
+	case r == 'n':
+		return `\n`, nil
+	case r < utf8.RuneSelf && isAlnum(byte(r)):
+		return "", errors.New(`\` + string(r) + " is not supported in the Plan 9 syntax")
+	case r < utf8.RuneSelf:
+		return `\` + string(r), nil
+	}
+	return string(r), nil
+}
+
+// plan9Class translates the character class following the [ that ends at
+// expr[*i], and advances *i past it.
+func plan9Class(expr string, i *int) (string, error) {
+	var b strings.Builder
+	b.WriteByte('[')
+	negated := strings.HasPrefix(expr[*i:], "^")
+	if negated {
+		b.WriteByte('^')
+		*i++
+	}
+	empty := true
+	for *i < len(expr) {
+		r, size := utf8.DecodeRuneInString(expr[*i:])
+		*i += size
+
+		switch r {
+		case ']':
+			if empty {
+				return "", errors.New("empty character class")
+			}
+			if negated {
+				b.WriteString(`\n`)
+			}
+			b.WriteByte(']')
+			return b.String(), nil
+		case '\\':
+			e, err := plan9Escape(expr, i)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(e)
+		case '[':
+			b.WriteString(`\[`)
+		default:
+			b.WriteRune(r)
+		}
+		empty = false
+	}
+	return "", errors.New("missing closing ]")
+}
+
+// plan9Replace returns the replacement text in the pattern capture n, written
+// in the Plan 9 syntax, as a template for sregx.S. In the Plan 9 syntax &
+// stands for the match, \1 through \9 for submatches, and a backslash makes
+// any other character literal.
+func plan9Replace(n *capture.Node, in *input.Input) []byte {
+	var t []byte
+	for _, c := range n.Children {
+		var lit []byte
+		switch c.Id {
+		case charId:
+			raw := in.Slice(c.Start(), c.End())
+			switch {
+			case raw[0] == '&':
+				t = append(t, "${0}"...)
+				continue
+			case raw[0] == '\\' && raw[1] >= '0' && raw[1] <= '9':
+				// The grammar reads \14 as an octal escape, but here it is
+				// the first submatch followed by 4.
+				t = append(t, "${"...)
+				t = append(t, raw[1], '}')
+				lit = raw[2:]
+			case raw[0] == '\\' && len(raw) == 2 && keptEscapes.Has(raw[1]):
+				lit = raw[1:2]
+			default:
+				lit = char(raw)
+			}
+		case delimId:
+			lit = in.Slice(c.Start(), c.End())[1:]
+		}
+		for _, b := range lit {
+			// Escape $ and \ so that neither is expanded by sregx.S.
+			if b == '$' || b == '\\' {
+				t = append(t, b)
+			}
+			t = append(t, b)
+		}
+	}
+	return t
+}
+
+func isAlnum(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
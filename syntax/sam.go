@@ -0,0 +1,506 @@
+package syntax
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/zyedidia/gpeg/input"
+	"github.com/zyedidia/gpeg/vm"
+	"github.com/zyedidia/sregx"
+)
+
+// CompileSam compiles s, a script in the command language of the sam editor,
+// into an sregx command. The script is a sequence of commands separated by
+// newlines, each of which may have an address, as in ",x/foo/c/bar/" or
+// "/begin/,/end/d". The commands x, y, g, v, c, a, i, d, p, s, = and blocks
+// in braces are supported, with sam's argument syntax: any delimiter, no
+// spaces needed between commands, and text on the lines following a, c, or i
+// up to a line holding only a period. Regular expressions use the Plan 9
+// syntax, as with the Plan9 option.
+//
+// Without an address, a command applies to all of its input: the whole text
+// at the top level, and the selection inside x, y, g, and v. A command with an
+// address applies to the part of its input that the address selects. Commands
+// that have no sregx equivalent, such as w or m, are reported as errors.
+func CompileSam(s string, out io.Writer, opts ...Option) (sregx.Command, error) {
+	sp := &samParser{
+		s:   s,
+		out: out,
+		cp:  &compiler{},
+	}
+	for _, opt := range opts {
+		opt(sp.cp)
+	}
+
+	var cmds sregx.CommandPipeline
+	for {
+		sp.skipSpace(true)
+		if sp.pos == len(sp.s) {
+			break
+		}
+		cmd, err := sp.command(false)
+		if err != nil {
+			return nil, MultiError{err}
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// samParser holds the state of a hand-written parser for sam scripts.
+type samParser struct {
+	s   string
+	pos int
+	out io.Writer
+	cp  *compiler
+
+	// last is the last regular expression read, which an empty regular
+	// expression refers to.
+	last string
+}
+
+func (sp *samParser) errorf(pos int, msg string) error {
+	return &vm.ParseError{
+		Pos:     input.PosFromOff(pos),
+		Message: msg,
+	}
+}
+
+func (sp *samParser) peek() byte {
+	if sp.pos < len(sp.s) {
+		return sp.s[sp.pos]
+	}
+	return 0
+}
+
+func (sp *samParser) next() byte {
+	c := sp.peek()
+	if sp.pos < len(sp.s) {
+		sp.pos++
+	}
+	return c
+}
+
+// skipSpace skips blanks, and newlines too if nl is set.
+func (sp *samParser) skipSpace(nl bool) {
+	for sp.pos < len(sp.s) {
+		c := sp.s[sp.pos]
+		if c != ' ' && c != '\t' && !(nl && c == '\n') {
+			break
+		}
+		sp.pos++
+	}
+}
+
+// command parses a command and its address. Inside x, y, g, or v, loop is
+// set.
+func (sp *samParser) command(loop bool) (sregx.Command, error) {
+	addr, err := sp.compoundAddr()
+	if err != nil {
+		return nil, err
+	}
+	sp.skipSpace(false)
+
+	start := sp.pos
+	var cmd sregx.Command
+	switch c := sp.next(); c {
+	case 'x', 'y', 'g', 'v':
+		cmd, err = sp.loop(c)
+	case 'c', 'a', 'i':
+		var text string
+		text, err = sp.text()
+		switch c {
+		case 'c':
+			cmd = sregx.C{Change: []byte(text)}
+		case 'a':
+			cmd = sregx.A{Text: []byte(text)}
+		case 'i':
+			cmd = sregx.I{Text: []byte(text)}
+		}
+	case 's':
+		cmd, err = sp.subst()
+	case 'd':
+		cmd = sregx.D{}
+	case 'p':
+		cmd = sregx.P{W: sp.out}
+	case '=':
+		if loop {
+			return nil, sp.errorf(start, "= has no sregx equivalent inside x, y, g, or v")
+		}
+		eq := sregx.Eq{
+			Addr: addr,
+			W:    sp.out,
+			Err:  sp.cp.errh,
+		}
+		if sp.peek() == '#' {
+			sp.next()
+			eq.Chars = true
+		}
+		return eq, nil
+	case '{':
+		cmd, err = sp.block(loop)
+	case 0, '\n':
+		return nil, sp.errorf(start, "missing command")
+	default:
+		if strings.IndexByte("bBDefnqruwWkmt<>|!", c) != -1 {
+			return nil, sp.errorf(start, "command "+string(c)+" has no sregx equivalent")
+		}
+		return nil, sp.errorf(start, "unknown command "+string(c))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if addr != nil {
+		cmd = sregx.At{
+			Addr: addr,
+			Cmd:  cmd,
+			Err:  sp.cp.errh,
+		}
+	}
+	return cmd, nil
+}
+
+// loop parses the regular expression and command following x, y, g, or v. An
+// x followed by a blank or the end of the line has no regular expression, and
+// selects lines.
+func (sp *samParser) loop(c byte) (sregx.Command, error) {
+	var patt sregx.Matcher
+	if d := sp.peek(); c == 'x' && (d == 0 || d == '\n' || isSpace(d)) {
+		patt = regexp.MustCompile(`.*\n`)
+	} else if isSamDelim(d) {
+		sp.next()
+		var err error
+		patt, err = sp.regex(d)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, sp.errorf(sp.pos, "missing regular expression")
+	}
+
+	sp.skipSpace(false)
+	cmd, err := sp.command(true)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 'x':
+		return sregx.X{Patt: patt, Cmd: cmd}, nil
+	case 'y':
+		return sregx.Y{Patt: patt, Cmd: cmd}, nil
+	case 'g':
+		return sregx.G{Patt: patt, Cmd: cmd}, nil
+	}
+	return sregx.V{Patt: patt, Cmd: cmd}, nil
+}
+
+// block parses the commands of a block up to the closing brace. The commands
+// are applied in turn.
+func (sp *samParser) block(loop bool) (sregx.Command, error) {
+	var cmds sregx.CommandPipeline
+	for {
+		sp.skipSpace(true)
+		switch sp.peek() {
+		case 0:
+			return nil, sp.errorf(sp.pos, "missing closing }")
+		case '}':
+			sp.next()
+			return cmds, nil
+		}
+		cmd, err := sp.command(loop)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// subst parses the rest of an s command: an optional occurrence number, the
+// regular expression, the replacement, and an optional g flag.
+func (sp *samParser) subst() (sregx.Command, error) {
+	n := 1
+	if c := sp.peek(); c >= '0' && c <= '9' {
+		n = sp.number()
+	}
+	if n < 1 {
+		return nil, sp.errorf(sp.pos, "occurrence must be positive")
+	}
+	d := sp.next()
+	if !isSamDelim(d) {
+		return nil, sp.errorf(sp.pos-1, "bad delimiter")
+	}
+	patt, err := sp.regex(d)
+	if err != nil {
+		return nil, err
+	}
+	s := sregx.S{
+		Patt:   patt,
+		Select: []sregx.Range{{Start: n - 1, End: n}},
+	}
+	repl := sp.rhs(d, 's')
+	if sp.peek() == d {
+		sp.next()
+		if sp.peek() == 'g' {
+			sp.next()
+			s.Select[0].End = -1
+		}
+	}
+	if _, ok := patt.(sregx.Submatcher); ok {
+		s.Replace = samTemplate(repl)
+	} else {
+		s.Replace = []byte(repl)
+	}
+	return s, nil
+}
+
+// text parses the text of a, c, or i, which is either delimited or, if the
+// command is followed by a newline, the lines up to one holding only a period.
+func (sp *samParser) text() (string, error) {
+	sp.skipSpace(false)
+	d := sp.peek()
+	if d == '\n' {
+		sp.next()
+		var b strings.Builder
+		for sp.pos < len(sp.s) {
+			end := strings.IndexByte(sp.s[sp.pos:], '\n')
+			if end == -1 {
+				end = len(sp.s) - sp.pos
+			} else {
+				end++
+			}
+			line := sp.s[sp.pos : sp.pos+end]
+			sp.pos += end
+			if strings.TrimSuffix(line, "\n") == "." {
+				break
+			}
+			b.WriteString(line)
+		}
+		return b.String(), nil
+	}
+	if !isSamDelim(d) {
+		return "", sp.errorf(sp.pos, "bad delimiter")
+	}
+	sp.next()
+	text := sp.rhs(d, 'a')
+	if sp.peek() == d {
+		sp.next()
+	}
+	return text, nil
+}
+
+// rhs reads the text or replacement following the delimiter d up to the
+// closing delimiter or the end of the line, as sam does. A backslash followed
+// by n is a newline, and one followed by the delimiter is the delimiter. In
+// text, two backslashes are one, and in the replacement of s the remaining
+// escapes are left to samTemplate.
+func (sp *samParser) rhs(d byte, cmd byte) string {
+	var b strings.Builder
+	for sp.pos < len(sp.s) {
+		c := sp.s[sp.pos]
+		if c == d || c == '\n' {
+			break
+		}
+		sp.pos++
+		if c == '\\' && sp.pos < len(sp.s) && sp.s[sp.pos] != '\n' {
+			c = sp.next()
+			if c == 'n' {
+				c = '\n'
+			} else if c != d && (cmd == 's' || c != '\\') {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// regex reads the regular expression following the delimiter d up to the
+// closing delimiter or the end of the line, and compiles it. An empty regular
+// expression is the last one read.
+func (sp *samParser) regex(d byte) (sregx.Matcher, error) {
+	start := sp.pos
+	var b strings.Builder
+	for sp.pos < len(sp.s) {
+		c := sp.s[sp.pos]
+		if c == '\n' {
+			break
+		}
+		sp.pos++
+		if c == d {
+			break
+		}
+		if c == '\\' && sp.pos < len(sp.s) {
+			switch sp.s[sp.pos] {
+			case d:
+				c = sp.next()
+			case '\\':
+				b.WriteByte(c)
+				c = sp.next()
+			}
+		}
+		b.WriteByte(c)
+	}
+
+	expr := b.String()
+	if expr == "" {
+		if sp.last == "" {
+			return nil, sp.errorf(start, "no previous regular expression")
+		}
+		expr = sp.last
+	}
+	sp.last = expr
+
+	if sp.cp.fixed {
+		return sregx.NewLiteral([]byte(expr)), nil
+	}
+	translated, err := plan9(expr)
+	if err != nil {
+		return nil, sp.errorf(start, err.Error())
+	}
+	re, err := regexp.Compile("(?m)" + translated)
+	if err != nil {
+		return nil, sp.errorf(start, err.Error())
+	}
+	if sp.cp.longest {
+		re.Longest()
+	}
+	return re, nil
+}
+
+// compoundAddr parses an address made of simple addresses joined by , or ;.
+// It returns nil if there is no address.
+func (sp *samParser) compoundAddr() (sregx.Address, error) {
+	sp.skipSpace(false)
+	left, err := sp.simpleAddr()
+	if err != nil {
+		return nil, err
+	}
+	sp.skipSpace(false)
+	op := sp.peek()
+	if op != ',' && op != ';' {
+		return left, nil
+	}
+	sp.next()
+	right, err := sp.compoundAddr()
+	if err != nil {
+		return nil, err
+	}
+	return sregx.CompoundAddr{
+		Left:  left,
+		Right: right,
+		Op:    op,
+	}, nil
+}
+
+// simpleAddr parses a simple address followed by any number of addresses
+// joined by + or -. As in sam, a + is implied between a simple address and a
+// following line number, character offset, or regular expression.
+func (sp *samParser) simpleAddr() (sregx.Address, error) {
+	left, err := sp.baseAddr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := sp.peek()
+		switch {
+		case op == '+' || op == '-':
+			sp.next()
+		case left != nil && strings.IndexByte("0123456789#/?", op) != -1:
+			op = '+'
+		case left != nil && strings.IndexByte(".$'", op) != -1:
+			return nil, sp.errorf(sp.pos, "bad address")
+		default:
+			return left, nil
+		}
+		right, err := sp.baseAddr()
+		if err != nil {
+			return nil, err
+		}
+		left = sregx.CompoundAddr{
+			Left:  left,
+			Right: right,
+			Op:    op,
+		}
+	}
+}
+
+// baseAddr parses a line number, a character offset, a regular expression, .
+// or $. It returns nil if there is none.
+func (sp *samParser) baseAddr() (sregx.Address, error) {
+	switch c := sp.peek(); {
+	case c >= '0' && c <= '9':
+		return sregx.LineAddr(sp.number()), nil
+	case c == '#':
+		sp.next()
+		n := 1
+		if c := sp.peek(); c >= '0' && c <= '9' {
+			n = sp.number()
+		}
+		return sregx.CharAddr(n), nil
+	case c == '/' || c == '?':
+		sp.next()
+		patt, err := sp.regex(c)
+		if err != nil {
+			return nil, err
+		}
+		return sregx.SearchAddr{
+			Patt:    patt,
+			Reverse: c == '?',
+		}, nil
+	case c == '.':
+		sp.next()
+		return sregx.DotAddr{}, nil
+	case c == '$':
+		sp.next()
+		return sregx.EndAddr{}, nil
+	case c == '\'':
+		return nil, sp.errorf(sp.pos, "marks have no sregx equivalent")
+	case c == '"':
+		return nil, sp.errorf(sp.pos, "file addresses have no sregx equivalent")
+	}
+	return nil, nil
+}
+
+func (sp *samParser) number() int {
+	n := 0
+	for c := sp.peek(); c >= '0' && c <= '9'; c = sp.peek() {
+		n = n*10 + int(sp.next()-'0')
+	}
+	return n
+}
+
+// isSamDelim reports whether c may delimit a regular expression or text, which
+// in sam is any character but a letter, digit, backslash, or space.
+func isSamDelim(c byte) bool {
+	return c != 0 && c != '\\' && c != '\n' && !isSpace(c) && !isAlnum(c)
+}
+
+// samTemplate converts the replacement of a sam s command to a template for
+// sregx.S. As with plan9Replace, & stands for the match, \1 through \9 for
+// submatches, and a backslash makes any other character literal.
+func samTemplate(repl string) []byte {
+	var t []byte
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		switch {
+		case c == '&':
+			t = append(t, "${0}"...)
+			continue
+		case c == '\\' && i+1 < len(repl):
+			i++
+			c = repl[i]
+			if c >= '0' && c <= '9' {
+				t = append(t, '$', '{', c, '}')
+				continue
+			}
+		}
+		// Escape $ and \ so that neither is expanded by sregx.S.
+		if c == '$' || c == '\\' {
+			t = append(t, c)
+		}
+		t = append(t, c)
+	}
+	return t
+}
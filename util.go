@@ -2,7 +2,11 @@ package sregx
 
 import (
 	"bytes"
+	"math"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // ReplaceAllComplementFunc returns a copy of b in which all parts that are not
@@ -10,25 +14,51 @@ import (
 // applied to the unmatched byte slice.  In other words, b is split according
 // to re, and all components of the split are replaced according to repl.
 func ReplaceAllComplementFunc(re *regexp.Regexp, b []byte, repl func([]byte) []byte) []byte {
-	matches := re.FindAllIndex(b, -1)
-	buf := make([]byte, 0, len(b))
+	pieces := complementIndex(re.FindAllIndex(b, -1), len(b))
+	return replaceAllIndex(b, pieces, func(i int, b []byte) []byte {
+		return repl(b)
+	})
+}
+
+// complementIndex returns the ranges of a byte slice of length n that lie
+// between the given matches.
+func complementIndex(matches [][]int, n int) [][]int {
+	pieces := make([][]int, 0, len(matches)+1)
 	beg := 0
 	end := 0
 
 	for _, match := range matches {
 		end = match[0]
 		if match[1] != 0 {
-			buf = append(buf, repl(b[beg:end])...)
-			buf = append(buf, b[end:match[1]]...)
+			pieces = append(pieces, []int{beg, end})
 		}
 		beg = match[1]
 	}
 
-	if end != len(b) {
-		buf = append(buf, repl(b[beg:])...)
+	if end != n {
+		pieces = append(pieces, []int{beg, n})
 	}
 
-	return buf
+	return pieces
+}
+
+// selectIndex returns the matches whose index is selected by one of the given
+// ranges, or all matches if there are no ranges.
+func selectIndex(rs []Range, matches [][]int) [][]int {
+	if len(rs) == 0 {
+		return matches
+	}
+
+	selected := make([][]int, 0, len(matches))
+	for i, match := range matches {
+		for _, r := range rs {
+			if r.Contains(i, len(matches)) {
+				selected = append(selected, match)
+				break
+			}
+		}
+	}
+	return selected
 }
 
 // IndexN find index of n-th sep in b
@@ -60,3 +90,131 @@ func ReplaceSlice(b []byte, start, end int, repl []byte) []byte {
 	dst = append(dst, b[end:]...)
 	return dst
 }
+
+// replaceAllIndex returns a copy of b in which the ranges given by matches have
+// been replaced with the return value of repl applied to the index of the match
+// and the matched byte slice. The matches must be ordered and may not overlap.
+func replaceAllIndex(b []byte, matches [][]int, repl func(i int, b []byte) []byte) []byte {
+	buf := make([]byte, 0, len(b))
+	beg := 0
+	for i, match := range matches {
+		buf = append(buf, b[beg:match[0]]...)
+		buf = append(buf, repl(i, b[match[0]:match[1]])...)
+		beg = match[1]
+	}
+	return append(buf, b[beg:]...)
+}
+
+// evaluateAll replaces the given ranges of b with the result of evaluating the
+// collective command c on all of them at once.
+func evaluateAll(c Collective, b []byte, matches [][]int) []byte {
+	bs := make([][]byte, len(matches))
+	for i, match := range matches {
+		bs[i] = b[match[0]:match[1]]
+	}
+	out := c.EvaluateAll(bs)
+	return replaceAllIndex(b, matches, func(i int, b []byte) []byte {
+		if i < len(out) {
+			return out[i]
+		}
+		return nil
+	})
+}
+
+// evaluatePieces replaces the given ranges of b with the result of evaluating
+// cmd on each of them, or on all of them together if cmd is a Collective or a
+// Reducer, as X does.
+func evaluatePieces(cmd Command, b []byte, matches [][]int) []byte {
+	switch cmd := cmd.(type) {
+	case Reducer:
+		return reduce(cmd, b, matches)
+	case Collective:
+		return evaluateAll(cmd, b, matches)
+	}
+	return replaceAllIndex(b, matches, func(i int, b []byte) []byte {
+		return cmd.Evaluate(b)
+	})
+}
+
+// pieces returns the locations of the pieces of a sequence of n units selected
+// by ranges, where off returns the offset of a unit, or the end of the sequence
+// for n. A range with a step greater than 1 selects each of its units as a
+// piece, and any other range is a single piece. The pieces are ordered, and
+// pieces that overlap are merged.
+func pieces(ranges []Range, n int, off func(i int) int) [][]int {
+	var ps [][]int
+	for _, r := range ranges {
+		start, end := r.bounds(n)
+		if start >= end {
+			continue
+		}
+		if r.Step <= 1 {
+			ps = append(ps, []int{off(start), off(end)})
+			continue
+		}
+		for i := start; i < end; i += r.Step {
+			ps = append(ps, []int{off(i), off(i + 1)})
+		}
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return ps[i][0] < ps[j][0]
+	})
+
+	var merged [][]int
+	for _, p := range ps {
+		if last := len(merged) - 1; last >= 0 && p[0] < merged[last][1] {
+			if p[1] > merged[last][1] {
+				merged[last][1] = p[1]
+			}
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// reduce replaces the region of b spanned by the given ranges with the result
+// of the reducer r applied to them.
+func reduce(r Reducer, b []byte, matches [][]int) []byte {
+	if len(matches) == 0 {
+		return b
+	}
+	bs := make([][]byte, len(matches))
+	for i, match := range matches {
+		bs[i] = b[match[0]:match[1]]
+	}
+	return ReplaceSlice(b, matches[0][0], matches[len(matches)-1][1], r.Reduce(bs))
+}
+
+// submatch returns the first submatch of re in b, or the whole match if re has
+// no submatches. It returns b if re is nil and nil if re does not match.
+func submatch(re *regexp.Regexp, b []byte) []byte {
+	if re == nil {
+		return b
+	}
+	m := re.FindSubmatch(b)
+	if m == nil {
+		return nil
+	}
+	if len(m) > 1 {
+		return m[1]
+	}
+	return m[0]
+}
+
+// parseNumber parses b, ignoring surrounding whitespace, as a decimal integer
+// or floating point number, or as an integer with a 0x, 0o, or 0b prefix.
+// Leading zeros do not denote octal.
+func parseNumber(b []byte) (float64, bool) {
+	s := strings.TrimSpace(string(b))
+	digits := strings.TrimLeft(s, "+-")
+	if len(digits) > 2 && digits[0] == '0' && strings.ContainsAny(digits[1:2], "xXoObB") {
+		i, err := strconv.ParseInt(s, 0, 64)
+		return float64(i), err == nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}